@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/beeper/mac-registration-provider/versions"
+)
+
+// apiServer serves validation data directly over HTTP, for clients that can reach the provider without a relay.
+type apiServer struct {
+	gen   Generator
+	token string
+}
+
+func (as *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !checkBearerToken(r, as.token) {
+		writeJSONResponse(w, http.StatusUnauthorized, ErrorResponse{Error: "invalid token"})
+		return
+	} else if r.Method != http.MethodGet {
+		writeJSONResponse(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+		return
+	}
+	start := time.Now()
+	switch r.URL.Path {
+	case "/validation-data":
+		data, err := cachedGenerateData(withMetricsMode(r.Context(), ModeAPI), as.gen)
+		emitEvent(EventCommand, CommandEvent{
+			ResultEvent: resultEvent(err),
+			Source:      ModeAPI,
+			Command:     "get-validation-data",
+			Duration:    time.Since(start).Seconds(),
+		})
+		if err != nil {
+			slog.Error("Failed to generate validation data for API request", "remote_addr", r.RemoteAddr, "error", err)
+			writeJSONResponse(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			return
+		}
+		slog.Info("Served validation data", "remote_addr", r.RemoteAddr)
+		writeJSONResponse(w, http.StatusOK, &ReqSubmitValidationData{
+			ValidationData: data.Data,
+			ValidUntil:     data.ValidUntil,
+			NacservCommit:  Commit,
+			DeviceInfo:     versions.Current,
+		})
+	case "/versions":
+		emitEvent(EventCommand, CommandEvent{
+			ResultEvent: resultEvent(nil),
+			Source:      ModeAPI,
+			Command:     "get-version-info",
+			Duration:    time.Since(start).Seconds(),
+		})
+		writeJSONResponse(w, http.StatusOK, currentVersionsResponse())
+	default:
+		writeJSONResponse(w, http.StatusNotFound, ErrorResponse{Error: "not found"})
+	}
+}
+
+// runAPIServer serves the API until ctx is canceled, after which in-flight requests are allowed to finish.
+func runAPIServer(ctx context.Context, gen Generator, cfg APIConfig) {
+	slog.Info("API mode: serving validation data", "url", fmt.Sprintf("http://%s/validation-data", cfg.Listen))
+	srv := &http.Server{Addr: cfg.Listen, Handler: &apiServer{gen: gen, token: cfg.Token}}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	err := srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		fatal("Failed to listen for API requests", "error", err)
+	}
+	// ListenAndServe returns as soon as shutdown starts, so wait for in-flight requests separately
+	<-shutdownDone
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type failingGenerator struct{}
+
+func (gen *failingGenerator) GenerateValidationData(ctx context.Context) ([]byte, time.Time, error) {
+	return nil, time.Time{}, errors.New("generation failed")
+}
+
+func TestAPIServer(t *testing.T) {
+	tests := []struct {
+		name   string
+		gen    Generator
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"missing token", &FakeGenerator{}, http.MethodGet, "/validation-data", "", http.StatusUnauthorized},
+		{"wrong token", &FakeGenerator{}, http.MethodGet, "/validation-data", "wrong", http.StatusUnauthorized},
+		// Auth is checked first, so unauthenticated clients can't probe which paths exist
+		{"unknown path without token", &FakeGenerator{}, http.MethodGet, "/secret", "", http.StatusUnauthorized},
+		{"post", &FakeGenerator{}, http.MethodPost, "/validation-data", "s3cret", http.StatusMethodNotAllowed},
+		{"delete", &FakeGenerator{}, http.MethodDelete, "/versions", "s3cret", http.StatusMethodNotAllowed},
+		{"unknown path", &FakeGenerator{}, http.MethodGet, "/secret", "s3cret", http.StatusNotFound},
+		{"root", &FakeGenerator{}, http.MethodGet, "/", "s3cret", http.StatusNotFound},
+		{"validation data", &FakeGenerator{}, http.MethodGet, "/validation-data", "s3cret", http.StatusOK},
+		{"versions", &FakeGenerator{}, http.MethodGet, "/versions", "s3cret", http.StatusOK},
+		{"generation error", &failingGenerator{}, http.MethodGet, "/validation-data", "s3cret", http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetCache(t)
+			rec := doReceiveRequest(t, &apiServer{gen: test.gen, token: "s3cret"}, test.method, test.path, test.token, nil)
+			if rec.Code != test.want {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, test.want, rec.Body.String())
+			} else if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("got Content-Type %q", contentType)
+			}
+			if test.want != http.StatusOK {
+				var errResp ErrorResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &errResp); err != nil || errResp.Error == "" {
+					t.Errorf("invalid error response %q: %v", rec.Body.String(), err)
+				}
+			} else if test.path == "/validation-data" {
+				var resp ReqSubmitValidationData
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.ValidationData) == 0 || time.Until(resp.ValidUntil) < minServeValidity {
+					t.Errorf("invalid validation data response %q: %v", rec.Body.String(), err)
+				}
+			}
+		})
+	}
+}
@@ -1,2 +1,3 @@
 #!/bin/sh
-go build -ldflags "-X main.Commit=$(git rev-parse HEAD)"
+# OFFSETS_PUBLIC_KEY is the base64 ed25519 public key that offsets databases must be signed with
+go build -ldflags "-X main.Commit=$(git rev-parse HEAD) -X github.com/beeper/mac-registration-provider/nac.OffsetsPublicKey=$OFFSETS_PUBLIC_KEY"
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// minServeValidity is how long cached data must still be valid for it to be served.
+// If nothing in the cache is valid for this long, new data is generated on the request path.
+const minServeValidity = 5 * time.Minute
+
+const prefetchRetryDelay = 30 * time.Second
+
+// validationPool holds recently generated validation data, ordered from oldest to freshest.
+// Entries are generated at staggered times, so that they don't all expire together,
+// and handed out in turns, so that consecutive callers get different data while the pool is full.
+type validationPool struct {
+	entries []*poolEntry
+	size    int
+}
+
+type poolEntry struct {
+	data      ValidationDataResponse
+	generated time.Time
+	// served is how many times the entry has been handed out.
+	served int
+}
+
+// get returns the least served entry that's valid for at least minValidity and expires after newerThan,
+// preferring fresher entries if several have been served equally often.
+func (pool *validationPool) get(minValidity time.Duration, newerThan time.Time) (ValidationDataResponse, bool) {
+	minValidUntil := time.Now().Add(minValidity)
+	var best *poolEntry
+	for i := len(pool.entries) - 1; i >= 0; i-- {
+		entry := pool.entries[i]
+		if !entry.data.ValidUntil.After(minValidUntil) || !entry.data.ValidUntil.After(newerThan) {
+			continue
+		} else if best == nil || entry.served < best.served {
+			best = entry
+		}
+	}
+	if best == nil {
+		return ValidationDataResponse{}, false
+	}
+	best.served++
+	return best.data, true
+}
+
+// add inserts an entry and evicts expired entries as well as the oldest ones if the pool is over capacity.
+func (pool *validationPool) add(data ValidationDataResponse, generated time.Time) {
+	pool.entries = append(pool.entries, &poolEntry{data: data, generated: generated})
+	sort.Slice(pool.entries, func(i, j int) bool {
+		return pool.entries[i].data.ValidUntil.Before(pool.entries[j].data.ValidUntil)
+	})
+	now := time.Now()
+	firstValid := 0
+	for firstValid < len(pool.entries) && !pool.entries[firstValid].data.ValidUntil.After(now) {
+		firstValid++
+	}
+	firstValid = max(firstValid, len(pool.entries)-max(pool.size, 1))
+	pool.entries = pool.entries[firstValid:]
+}
+
+// nextRefresh returns when the pool should be topped up, given how long before expiry data should be refreshed.
+// The time each entry is usable for (i.e. its lifetime minus the lead time) is split evenly between the entries
+// of a full pool, so new data is generated once the freshest entry has used up its share. With a pool size of 1,
+// this means refreshing exactly the lead time before the freshest entry expires.
+func (pool *validationPool) nextRefresh(leadTime time.Duration) time.Time {
+	if len(pool.entries) == 0 {
+		return time.Now()
+	}
+	freshest := pool.entries[len(pool.entries)-1]
+	usableTime := freshest.data.ValidUntil.Sub(freshest.generated) - leadTime
+	return freshest.generated.Add(usableTime / time.Duration(max(pool.size, 1)))
+}
+
+var dataPool = &validationPool{size: 1}
+
+// cacheLock protects dataPool and currentGeneration. It's never held while generating.
+var cacheLock sync.Mutex
+
+// generation is a single in-flight call to the generator that any number of callers can wait for.
+type generation struct {
+	done chan struct{}
+	data ValidationDataResponse
+	err  error
+}
+
+var currentGeneration *generation
+
+// wait waits for the generation to finish, or for the caller's context to be canceled.
+// Canceling the wait doesn't cancel the generation, so other waiters still get the result.
+func (g *generation) wait(ctx context.Context) (ValidationDataResponse, error) {
+	select {
+	case <-g.done:
+		return g.data, g.err
+	case <-ctx.Done():
+		return ValidationDataResponse{}, ctx.Err()
+	}
+}
+
+func cachedGenerateData(ctx context.Context, gen Generator) (ValidationDataResponse, error) {
+	return cachedGenerateDataFor(ctx, gen, minServeValidity, time.Time{})
+}
+
+// cachedGenerateDataFor returns cached data that's valid for at least minValidity and expires after newerThan,
+// or generates new data if there's no such data in the cache.
+func cachedGenerateDataFor(ctx context.Context, gen Generator, minValidity time.Duration, newerThan time.Time) (ValidationDataResponse, error) {
+	cacheLock.Lock()
+	mode := metricsMode(ctx)
+	if data, ok := dataPool.get(minValidity, newerThan); ok {
+		cacheLock.Unlock()
+		metricCacheLookups.WithLabelValues(mode, "hit").Inc()
+		return data, nil
+	}
+	metricCacheLookups.WithLabelValues(mode, "miss").Inc()
+	flight := startGenerationLocked(ctx, gen)
+	cacheLock.Unlock()
+	return flight.wait(ctx)
+}
+
+// startGenerationLocked returns the in-flight generation, or starts a new one if there isn't one.
+// The generation isn't tied to the context of the caller that started it (other than for metrics),
+// so it finishes even if that caller stops waiting. The caller must hold cacheLock.
+func startGenerationLocked(ctx context.Context, gen Generator) *generation {
+	if currentGeneration != nil {
+		return currentGeneration
+	}
+	flight := &generation{done: make(chan struct{})}
+	currentGeneration = flight
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		start := time.Now()
+		data, validUntil, err := generateRecoveringPanics(ctx, gen)
+		metricGenerationDuration.WithLabelValues(metricsMode(ctx), resultLabel(err)).Observe(time.Since(start).Seconds())
+		health.recordGeneration(err)
+		cacheLock.Lock()
+		if err != nil {
+			flight.err = err
+		} else {
+			flight.data = ValidationDataResponse{Data: data, ValidUntil: validUntil}
+			dataPool.add(flight.data, start)
+		}
+		currentGeneration = nil
+		cacheLock.Unlock()
+		close(flight.done)
+	}()
+	return flight
+}
+
+// generateRecoveringPanics calls the generator and turns panics into errors. Generation runs in its own goroutine,
+// where an unrecovered panic (e.g. from unexpected data from Apple's servers) would crash the whole process.
+func generateRecoveringPanics(ctx context.Context, gen Generator) (data []byte, validUntil time.Time, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			metricGenerationPanics.Inc()
+			slog.Error("Panic while generating validation data", "error", p, "stack", string(debug.Stack()))
+			err = fmt.Errorf("panic while generating validation data: %v", p)
+		}
+	}()
+	return gen.GenerateValidationData(ctx)
+}
+
+// runPrefetcher keeps the pool warm by generating new data on the schedule from validationPool.nextRefresh,
+// so that requests never have to wait for generation.
+// A random jitter is subtracted from each refresh time to avoid many providers refreshing in sync.
+func runPrefetcher(ctx context.Context, gen Generator, cfg CacheConfig) {
+	ctx = withMetricsMode(ctx, "prefetch")
+	cacheLock.Lock()
+	dataPool.size = cfg.PoolSize
+	cacheLock.Unlock()
+	slog.Info("Prefetching validation data", "lead_time", cfg.LeadTime, "jitter", cfg.Jitter, "pool_size", cfg.PoolSize)
+	for {
+		cacheLock.Lock()
+		nextRefresh := dataPool.nextRefresh(cfg.LeadTime)
+		cacheLock.Unlock()
+		if cfg.Jitter > 0 {
+			nextRefresh = nextRefresh.Add(-time.Duration(rand.Int63n(int64(cfg.Jitter))))
+		}
+		select {
+		case <-time.After(time.Until(nextRefresh)):
+		case <-ctx.Done():
+			return
+		}
+		cacheLock.Lock()
+		flight := startGenerationLocked(ctx, gen)
+		cacheLock.Unlock()
+		data, err := flight.wait(ctx)
+		if err != nil {
+			slog.Warn("Failed to prefetch validation data", "error", err, "retry_in", prefetchRetryDelay)
+			select {
+			case <-time.After(prefetchRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+		} else {
+			slog.Info("Prefetched validation data", "valid_until", data.ValidUntil)
+		}
+	}
+}
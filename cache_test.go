@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func testPoolData(name string, validFor time.Duration) ValidationDataResponse {
+	return ValidationDataResponse{Data: []byte(name), ValidUntil: time.Now().Add(validFor)}
+}
+
+func TestValidationPoolHandsOutDistinctEntries(t *testing.T) {
+	pool := &validationPool{size: 3}
+	now := time.Now()
+	pool.add(testPoolData("a", 9*time.Minute), now.Add(-6*time.Minute))
+	pool.add(testPoolData("b", 12*time.Minute), now.Add(-3*time.Minute))
+	pool.add(testPoolData("c", 15*time.Minute), now)
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		data, ok := pool.get(minServeValidity, time.Time{})
+		if !ok {
+			t.Fatal("pool didn't return data")
+		}
+		got = append(got, string(data.Data))
+	}
+	// The freshest entry is used first, then each of the others before any is reused
+	if fmt.Sprint(got) != "[c b a c]" {
+		t.Errorf("unexpected order %v", got)
+	}
+
+	// Entries that aren't valid for long enough or aren't newer than requested are skipped
+	if data, ok := pool.get(10*time.Minute, time.Time{}); !ok || string(data.Data) != "b" {
+		t.Errorf("unexpected data with minimum validity: %q %v", data.Data, ok)
+	}
+	if _, ok := pool.get(15*time.Minute, time.Time{}); ok {
+		t.Error("got data that isn't valid for long enough")
+	}
+	if data, ok := pool.get(minServeValidity, now.Add(13*time.Minute)); !ok || string(data.Data) != "c" {
+		t.Errorf("unexpected data newer than b: %q %v", data.Data, ok)
+	}
+}
+
+func TestValidationPoolEviction(t *testing.T) {
+	pool := &validationPool{size: 2}
+	now := time.Now()
+	pool.add(testPoolData("expired", -time.Second), now.Add(-ValidityTime))
+	pool.add(testPoolData("a", 5*time.Minute), now)
+	pool.add(testPoolData("b", 10*time.Minute), now)
+	pool.add(testPoolData("c", 15*time.Minute), now)
+	if len(pool.entries) != 2 || string(pool.entries[0].data.Data) != "b" || string(pool.entries[1].data.Data) != "c" {
+		var names []string
+		for _, entry := range pool.entries {
+			names = append(names, string(entry.data.Data))
+		}
+		t.Errorf("unexpected entries after eviction: %v", names)
+	}
+}
+
+func TestValidationPoolStaggersRefreshes(t *testing.T) {
+	const leadTime = 7 * time.Minute
+	for _, size := range []int{1, 2, 4} {
+		t.Run(fmt.Sprintf("size %d", size), func(t *testing.T) {
+			pool := &validationPool{size: size}
+			if next := pool.nextRefresh(leadTime); time.Until(next) > 0 {
+				t.Errorf("empty pool isn't refreshed immediately: %v", next)
+			}
+			generated := time.Now()
+			pool.add(ValidationDataResponse{ValidUntil: generated.Add(ValidityTime)}, generated)
+			wantSpacing := (ValidityTime - leadTime) / time.Duration(size)
+			if next := pool.nextRefresh(leadTime); !next.Equal(generated.Add(wantSpacing)) {
+				t.Errorf("next refresh is %v after generation, want %v", next.Sub(generated), wantSpacing)
+			}
+		})
+	}
+	// In the steady state, a full pool always has one entry per time slot, the oldest of which
+	// reaches the lead time when the next one is generated.
+	pool := &validationPool{size: 4}
+	spacing := (ValidityTime - leadTime) / 4
+	start := time.Now().Add(-3 * spacing)
+	for i := 0; i < 4; i++ {
+		generated := start.Add(time.Duration(i) * spacing)
+		pool.add(ValidationDataResponse{ValidUntil: generated.Add(ValidityTime)}, generated)
+	}
+	next := pool.nextRefresh(leadTime)
+	if oldestRemaining := pool.entries[0].data.ValidUntil.Sub(next); oldestRemaining != leadTime {
+		t.Errorf("oldest entry has %v left at the next refresh, want %v", oldestRemaining, leadTime)
+	}
+}
+
+// blockingGenerator waits until it's released before returning data and counts its calls.
+type blockingGenerator struct {
+	release chan struct{}
+	calls   chan struct{}
+	err     error
+}
+
+func (gen *blockingGenerator) GenerateValidationData(ctx context.Context) ([]byte, time.Time, error) {
+	gen.calls <- struct{}{}
+	<-gen.release
+	return []byte("data"), time.Now().Add(ValidityTime), gen.err
+}
+
+func TestGenerationSingleFlight(t *testing.T) {
+	resetCache(t)
+	gen := &blockingGenerator{release: make(chan struct{}), calls: make(chan struct{}, 10), err: errors.New("generation failed")}
+	cacheLock.Lock()
+	flight := startGenerationLocked(context.Background(), gen)
+	if again := startGenerationLocked(context.Background(), gen); again != flight {
+		t.Error("second caller started a new generation instead of joining the in-flight one")
+	}
+	cacheLock.Unlock()
+	<-gen.calls
+
+	const waiters = 3
+	results := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			_, err := flight.wait(context.Background())
+			results <- err
+		}()
+	}
+	// A waiter that gives up doesn't affect the generation or the other waiters
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := flight.wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled waiter got %v", err)
+	}
+	close(gen.release)
+	for i := 0; i < waiters; i++ {
+		if err := <-results; err == nil || err.Error() != "generation failed" {
+			t.Errorf("waiter %d got %v", i, err)
+		}
+	}
+	if len(gen.calls) != 0 {
+		t.Errorf("generator was called %d extra times", len(gen.calls))
+	}
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	if currentGeneration != nil {
+		t.Error("finished generation is still marked as in flight")
+	}
+}
+
+func generationPanics(t *testing.T) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == metricsNamespace+"_generation_panics_total" {
+			return family.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	t.Fatal("panic metric not found")
+	return 0
+}
+
+type panickingGenerator struct{}
+
+func (gen *panickingGenerator) GenerateValidationData(ctx context.Context) ([]byte, time.Time, error) {
+	var response []byte
+	_ = &response[0]
+	return nil, time.Time{}, nil
+}
+
+func TestGenerationPanicBecomesError(t *testing.T) {
+	resetCache(t)
+	before := generationPanics(t)
+	_, err := cachedGenerateData(context.Background(), &panickingGenerator{})
+	if err == nil || !strings.Contains(err.Error(), "panic while generating validation data") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if panics := generationPanics(t) - before; panics != 1 {
+		t.Errorf("panic metric increased by %v, want 1", panics)
+	}
+	// The cache must still work after a panic
+	if _, err = cachedGenerateData(context.Background(), &FakeGenerator{}); err != nil {
+		t.Errorf("generation after panic failed: %v", err)
+	}
+}
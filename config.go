@@ -0,0 +1,478 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ProviderConfig is the structured config file that describes everything the provider should do.
+// It can be written in YAML or JSON. Command-line flags override the values in the file.
+type ProviderConfig struct {
+	// Generator is the validation data generator to use: nac or fake.
+	Generator string `yaml:"generator"`
+	// Modes lists the modes to run: relay, submit, api and/or socket. Defaults to relay only.
+	Modes   []string         `yaml:"modes"`
+	Relay   RelayModeConfig  `yaml:"relay"`
+	Submit  SubmitModeConfig `yaml:"submit"`
+	API     APIConfig        `yaml:"api"`
+	Socket  SocketConfig     `yaml:"socket"`
+	Cache   CacheConfig      `yaml:"cache"`
+	Offsets OffsetsConfig    `yaml:"offsets"`
+	Logging LoggingConfig    `yaml:"logging"`
+	Metrics MetricsConfig    `yaml:"metrics"`
+}
+
+type RelayModeConfig struct {
+	Servers []RelayServerConfig `yaml:"servers"`
+}
+
+type RelayServerConfig struct {
+	URL string `yaml:"url"`
+	// ConfigPath is the file where the registration code for this relay is saved.
+	// Defaults to config.json for the first relay and relay-<host>.json for others.
+	ConfigPath string `yaml:"config_path"`
+}
+
+type SubmitModeConfig struct {
+	// Interval and Token are the defaults for targets that don't specify their own.
+	Interval time.Duration  `yaml:"interval"`
+	Token    string         `yaml:"token"`
+	Targets  []SubmitTarget `yaml:"targets"`
+	// Outbox is a file where undelivered payloads are saved, so they can be redelivered after a restart.
+	Outbox string `yaml:"outbox"`
+}
+
+type SubmitTarget struct {
+	URL string `yaml:"url"`
+	// Name identifies the target in metrics. Defaults to the host and path of the URL.
+	Name     string        `yaml:"name"`
+	Interval time.Duration `yaml:"interval"`
+
+	// Token is sent as a bearer token in the Authorization header.
+	Token     string           `yaml:"token"`
+	BasicAuth *BasicAuthConfig `yaml:"basic_auth"`
+	// Headers are static headers added to every request.
+	Headers map[string]string `yaml:"headers"`
+	HMAC    *HMACConfig       `yaml:"hmac"`
+}
+
+type BasicAuthConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// HMACConfig makes the submitter sign the request body with HMAC-SHA256 using a shared secret.
+// The signature is sent as "sha256=<hex>" in the given header.
+type HMACConfig struct {
+	Secret string `yaml:"secret"`
+	Header string `yaml:"header"`
+}
+
+const defaultHMACHeader = "X-Signature-256"
+
+// APIConfig configures the local HTTP API that serves validation data directly.
+type APIConfig struct {
+	Listen string `yaml:"listen"`
+	// Token is the bearer token that clients must provide.
+	Token string `yaml:"token"`
+}
+
+// SocketConfig configures the unix socket that serves validation data to local clients.
+type SocketConfig struct {
+	Path string `yaml:"path"`
+	// Mode is the octal file mode of the socket, defaults to 0600 (only the current user).
+	Mode string `yaml:"mode"`
+	// Group is the name of the group to give the socket to, which is useful with mode 0660.
+	Group string `yaml:"group"`
+}
+
+func (sc *SocketConfig) FileMode() (os.FileMode, error) {
+	if sc.Mode == "" {
+		return 0600, nil
+	}
+	mode, err := strconv.ParseUint(sc.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %q", sc.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// CacheConfig configures the background prefetcher that keeps the validation data cache warm.
+type CacheConfig struct {
+	Prefetch bool `yaml:"prefetch"`
+	// LeadTime is how long before the freshest data expires that new data is generated.
+	LeadTime time.Duration `yaml:"lead_time"`
+	// Jitter is the maximum random duration subtracted from each refresh time.
+	Jitter time.Duration `yaml:"jitter"`
+	// PoolSize is the number of unexpired payloads to keep.
+	PoolSize int `yaml:"pool_size"`
+}
+
+type OffsetsConfig struct {
+	// File is a signed offsets database to use in addition to the built-in offsets.
+	// Defaults to offsets.json in the config directory if it exists.
+	File string `yaml:"file"`
+	// URL is where to fetch updated offsets databases from. The signature is fetched from the same URL
+	// with ".sig" appended to the path. Updates are cached in offsets-cache.json in the config directory.
+	URL string `yaml:"url"`
+	// UpdateInterval is how often to check the URL for updates.
+	UpdateInterval time.Duration `yaml:"update_interval"`
+	// SignatureScan enables finding offsets by scanning identityservicesd for the NAC function signatures
+	// in the offsets database if there are no offsets for its exact hash.
+	SignatureScan bool `yaml:"signature_scan"`
+}
+
+type LoggingConfig struct {
+	// JSON makes the results (e.g. the registration code) be printed to stdout as JSON.
+	JSON bool `yaml:"json"`
+	// Level is the minimum log level: debug, info, warn or error.
+	Level string `yaml:"level"`
+	// Format is the log format: text or json. Logs are always written to stderr.
+	Format string `yaml:"format"`
+}
+
+type MetricsConfig struct {
+	// Listen is the address to serve Prometheus metrics on. Metrics are disabled if empty.
+	Listen string `yaml:"listen"`
+}
+
+const (
+	ModeRelay  = "relay"
+	ModeSubmit = "submit"
+	ModeAPI    = "api"
+	ModeSocket = "socket"
+)
+
+// getConfigFilePath returns the path of the config file and whether it was explicitly specified.
+func getConfigFilePath() (string, bool, error) {
+	if *configFilePath != "" {
+		return *configFilePath, true, nil
+	}
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", false, err
+	}
+	return filepath.Join(configDir, "provider.yaml"), false, nil
+}
+
+// loadProviderConfig reads the config file. A missing file is only an error if the path was explicitly specified.
+func loadProviderConfig() (*ProviderConfig, error) {
+	path, explicit, err := getConfigFilePath()
+	if err != nil {
+		return nil, err
+	}
+	var cfg ProviderConfig
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return &cfg, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	err = decoder.Decode(&cfg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// setFlagNames returns the names of the command-line flags that were explicitly set.
+func setFlagNames() map[string]bool {
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	return setFlags
+}
+
+// applyFlags overrides config file values with the command-line flags in setFlags and the submit URLs in args.
+// If any mode-specific flag (-relay-server, -submit-interval, -listen or -socket) enables a mode, the modes are
+// also determined by the flags rather than the config file.
+func (cfg *ProviderConfig) applyFlags(setFlags map[string]bool, args []string) {
+	if setFlags["generator"] {
+		cfg.Generator = *generatorType
+	}
+	if setFlags["json"] {
+		cfg.Logging.JSON = *jsonOutput
+	}
+	if setFlags["log-level"] {
+		cfg.Logging.Level = *logLevel
+	}
+	if setFlags["log-format"] {
+		cfg.Logging.Format = *logFormat
+	}
+	if setFlags["listen"] {
+		cfg.API.Listen = *apiListen
+	}
+	if setFlags["listen-token"] {
+		cfg.API.Token = *apiToken
+	}
+	if setFlags["socket"] {
+		cfg.Socket.Path = *socketPath
+	}
+	if setFlags["socket-mode"] {
+		cfg.Socket.Mode = *socketMode
+	}
+	if setFlags["socket-group"] {
+		cfg.Socket.Group = *socketGroup
+	}
+	if setFlags["prefetch"] {
+		cfg.Cache.Prefetch = *prefetch
+	}
+	if setFlags["offsets-file"] {
+		cfg.Offsets.File = *offsetsFile
+	}
+	if setFlags["offsets-url"] {
+		cfg.Offsets.URL = *offsetsURL
+	}
+	if setFlags["offsets-signature-scan"] {
+		cfg.Offsets.SignatureScan = *offsetsSignatureScan
+	}
+	if setFlags["metrics-listen"] {
+		cfg.Metrics.Listen = *metricsListen
+	}
+	if setFlags["submit-token"] {
+		cfg.Submit.Token = *submitToken
+	}
+	if setFlags["submit-interval"] {
+		cfg.Submit.Interval = *submitInterval
+	}
+	if setFlags["submit-outbox"] {
+		cfg.Submit.Outbox = *submitOutboxPath
+	}
+	if urls := args; len(urls) > 0 {
+		cfg.Submit.Targets = make([]SubmitTarget, len(urls))
+		for i, u := range urls {
+			cfg.Submit.Targets[i] = SubmitTarget{URL: u}
+		}
+	}
+	if setFlags["relay-server"] {
+		servers := relayServerFlag.NonEmpty()
+		cfg.Relay.Servers = make([]RelayServerConfig, len(servers))
+		for i, addr := range servers {
+			cfg.Relay.Servers[i] = RelayServerConfig{URL: addr}
+		}
+	}
+	if setFlags["submit-interval"] || setFlags["relay-server"] || setFlags["listen"] || setFlags["socket"] {
+		var modes []string
+		if *submitInterval > 0 {
+			modes = append(modes, ModeSubmit)
+		}
+		if setFlags["relay-server"] && len(cfg.Relay.Servers) > 0 {
+			modes = append(modes, ModeRelay)
+		}
+		if cfg.API.Listen != "" {
+			modes = append(modes, ModeAPI)
+		}
+		if cfg.Socket.Path != "" {
+			modes = append(modes, ModeSocket)
+		}
+		// Flags like -submit-interval 0 don't enable anything, so they shouldn't disable the configured modes either
+		if len(modes) > 0 {
+			cfg.Modes = modes
+		}
+	}
+}
+
+// applyDefaults fills in default values for fields that weren't specified anywhere.
+func (cfg *ProviderConfig) applyDefaults() {
+	if cfg.Generator == "" {
+		cfg.Generator = "nac"
+	}
+	if cfg.Modes == nil {
+		cfg.Modes = []string{ModeRelay}
+	}
+	if cfg.HasMode(ModeRelay) && len(cfg.Relay.Servers) == 0 {
+		cfg.Relay.Servers = []RelayServerConfig{{URL: defaultRelayServer}}
+	}
+	if cfg.Logging.Level == "" {
+		cfg.Logging.Level = "info"
+	}
+	if cfg.Logging.Format == "" {
+		cfg.Logging.Format = "text"
+	}
+	if cfg.Offsets.UpdateInterval == 0 {
+		cfg.Offsets.UpdateInterval = 24 * time.Hour
+	}
+	if cfg.Cache.LeadTime == 0 {
+		cfg.Cache.LeadTime = 7 * time.Minute
+	}
+	if cfg.Cache.Jitter == 0 {
+		cfg.Cache.Jitter = 30 * time.Second
+	}
+	if cfg.Cache.PoolSize == 0 {
+		cfg.Cache.PoolSize = 1
+	}
+	for i := range cfg.Submit.Targets {
+		target := &cfg.Submit.Targets[i]
+		if target.Token == "" && target.BasicAuth == nil {
+			target.Token = cfg.Submit.Token
+		}
+		if target.HMAC != nil && target.HMAC.Header == "" {
+			target.HMAC.Header = defaultHMACHeader
+		}
+		if target.Interval == 0 {
+			target.Interval = cfg.Submit.Interval
+		}
+	}
+}
+
+func (cfg *ProviderConfig) HasMode(mode string) bool {
+	return slices.Contains(cfg.Modes, mode)
+}
+
+func validateHTTPURL(u string) error {
+	parsedURL, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("failed to parse URL %q: %w", u, err)
+	} else if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return fmt.Errorf("unexpected URL scheme %q in %q", parsedURL.Scheme, u)
+	}
+	return nil
+}
+
+// Validate checks the config (after defaults have been applied) and returns all problems found.
+func (cfg *ProviderConfig) Validate() []error {
+	var errs []error
+	switch cfg.Generator {
+	case "nac", "fake":
+	default:
+		errs = append(errs, fmt.Errorf("unknown generator %q, must be nac or fake", cfg.Generator))
+	}
+	var level slog.Level
+	if level.UnmarshalText([]byte(cfg.Logging.Level)) != nil {
+		errs = append(errs, fmt.Errorf("unknown log level %q, must be debug, info, warn or error", cfg.Logging.Level))
+	}
+	switch cfg.Logging.Format {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("unknown log format %q, must be text or json", cfg.Logging.Format))
+	}
+	if len(cfg.Modes) == 0 {
+		errs = append(errs, fmt.Errorf("no modes enabled, must enable at least one of relay, submit, api or socket"))
+	}
+	for _, mode := range cfg.Modes {
+		if mode != ModeRelay && mode != ModeSubmit && mode != ModeAPI && mode != ModeSocket {
+			errs = append(errs, fmt.Errorf("unknown mode %q, must be relay, submit, api or socket", mode))
+		}
+	}
+	if cfg.HasMode(ModeRelay) {
+		seen := make(map[string]bool)
+		for i, server := range cfg.Relay.Servers {
+			if err := validateHTTPURL(server.URL); err != nil {
+				errs = append(errs, fmt.Errorf("relay server #%d: %w", i+1, err))
+			} else if seen[server.URL] {
+				errs = append(errs, fmt.Errorf("relay server #%d: duplicate URL %q", i+1, server.URL))
+			}
+			seen[server.URL] = true
+			// Fake data must never be registered with the production relay that real users depend on
+			if cfg.Generator == "fake" && server.URL == defaultRelayServer {
+				errs = append(errs, fmt.Errorf("relay server #%d: the fake generator can't be used with the default relay server, set a different relay server", i+1))
+			}
+		}
+	}
+	if cfg.HasMode(ModeSubmit) {
+		if len(cfg.Submit.Targets) == 0 {
+			errs = append(errs, fmt.Errorf("submit mode requires at least one target"))
+		}
+		for i, target := range cfg.Submit.Targets {
+			if err := validateHTTPURL(target.URL); err != nil {
+				errs = append(errs, fmt.Errorf("submit target #%d: %w", i+1, err))
+			}
+			if target.Interval <= 0 {
+				errs = append(errs, fmt.Errorf("submit target #%d: interval must be positive", i+1))
+			}
+			if target.Token != "" && target.BasicAuth != nil {
+				errs = append(errs, fmt.Errorf("submit target #%d: token and basic_auth can't be used together", i+1))
+			}
+			for name := range target.Headers {
+				if http.CanonicalHeaderKey(name) == "Authorization" && (target.Token != "" || target.BasicAuth != nil) {
+					errs = append(errs, fmt.Errorf("submit target #%d: Authorization header conflicts with token or basic_auth", i+1))
+				}
+			}
+			if target.HMAC != nil && target.HMAC.Secret == "" {
+				errs = append(errs, fmt.Errorf("submit target #%d: hmac secret must not be empty", i+1))
+			}
+		}
+	}
+	if cfg.HasMode(ModeAPI) {
+		if cfg.API.Listen == "" {
+			errs = append(errs, fmt.Errorf("api mode requires a listen address"))
+		}
+		if cfg.API.Token == "" {
+			errs = append(errs, fmt.Errorf("api mode requires a token"))
+		}
+	}
+	if cfg.Offsets.URL != "" {
+		if err := validateHTTPURL(cfg.Offsets.URL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid offsets URL: %w", err))
+		}
+		if cfg.Offsets.UpdateInterval < time.Minute {
+			errs = append(errs, fmt.Errorf("offsets update_interval must be at least 1m"))
+		}
+	}
+	if cfg.Cache.Prefetch {
+		if cfg.Cache.LeadTime < minServeValidity || cfg.Cache.LeadTime >= ValidityTime {
+			errs = append(errs, fmt.Errorf("cache lead_time must be between %v and %v", minServeValidity, ValidityTime))
+		}
+		if cfg.Cache.Jitter < 0 || cfg.Cache.LeadTime+cfg.Cache.Jitter >= ValidityTime {
+			errs = append(errs, fmt.Errorf("cache jitter must be non-negative and less than %v minus the lead time", ValidityTime))
+		}
+		if cfg.Cache.PoolSize < 1 {
+			errs = append(errs, fmt.Errorf("cache pool_size must be at least 1"))
+		}
+	}
+	if cfg.HasMode(ModeSocket) {
+		if cfg.Socket.Path == "" {
+			errs = append(errs, fmt.Errorf("socket mode requires a socket path"))
+		}
+		if _, err := cfg.Socket.FileMode(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// resolveConfig loads the config file, applies flag overrides and defaults, and validates the result.
+func resolveConfig() (*ProviderConfig, error) {
+	cfg, err := loadProviderConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg.applyFlags(setFlagNames(), flag.Args())
+	cfg.applyDefaults()
+	return cfg, errors.Join(cfg.Validate()...)
+}
+
+func cmdConfig(args []string) {
+	if len(args) == 0 || args[0] != "validate" {
+		_, _ = fmt.Fprintln(os.Stderr, "Usage: mac-registration-provider config validate [flags]")
+		os.Exit(exitCodeInvalidConfig)
+	}
+	_ = flag.CommandLine.Parse(args[1:])
+	cfg, err := resolveConfig()
+	if err != nil {
+		// Validation errors are joined with newlines, print each of them on its own line
+		for _, line := range strings.Split(err.Error(), "\n") {
+			_, _ = fmt.Fprintln(os.Stderr, "Error:", line)
+		}
+		os.Exit(exitCodeInvalidConfig)
+	}
+	fmt.Printf("Config is valid: generator %s, modes %v, %d relay server(s), %d submit target(s)\n",
+		cfg.Generator, cfg.Modes, len(cfg.Relay.Servers), len(cfg.Submit.Targets))
+}
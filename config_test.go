@@ -0,0 +1,269 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// setTestFlags sets the given command-line flags for the duration of the test
+// and returns the set of flag names in the form applyFlags expects.
+func setTestFlags(t *testing.T, values map[string]string) map[string]bool {
+	t.Helper()
+	savedRelayServers := slices.Clone(relayServerFlag)
+	relayServerFlag = nil
+	setFlags := make(map[string]bool)
+	for name, value := range values {
+		f := flag.Lookup(name)
+		if f == nil {
+			t.Fatalf("unknown flag %s", name)
+		}
+		if name != "relay-server" {
+			oldValue := f.Value.String()
+			t.Cleanup(func() { _ = f.Value.Set(oldValue) })
+		}
+		if err := f.Value.Set(value); err != nil {
+			t.Fatal(err)
+		}
+		setFlags[name] = true
+	}
+	t.Cleanup(func() { relayServerFlag = savedRelayServers })
+	return setFlags
+}
+
+// loadTestConfig writes the given YAML to a temporary config file and loads it.
+func loadTestConfig(t *testing.T, yaml string) *ProviderConfig {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "provider.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := *configFilePath
+	*configFilePath = path
+	t.Cleanup(func() { *configFilePath = oldPath })
+	cfg, err := loadProviderConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func resolveTestConfig(t *testing.T, yaml string, flags map[string]string, args ...string) (*ProviderConfig, []error) {
+	t.Helper()
+	cfg := loadTestConfig(t, yaml)
+	cfg.applyFlags(setTestFlags(t, flags), args)
+	cfg.applyDefaults()
+	return cfg, cfg.Validate()
+}
+
+func TestConfigDefaults(t *testing.T) {
+	cfg, errs := resolveTestConfig(t, "", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if cfg.Generator != "nac" {
+		t.Errorf("unexpected generator %q", cfg.Generator)
+	}
+	if !slices.Equal(cfg.Modes, []string{ModeRelay}) {
+		t.Errorf("unexpected modes %v", cfg.Modes)
+	}
+	if len(cfg.Relay.Servers) != 1 || cfg.Relay.Servers[0].URL != defaultRelayServer {
+		t.Errorf("unexpected relay servers %+v", cfg.Relay.Servers)
+	}
+	if cfg.Logging.Level != "info" || cfg.Logging.Format != "text" {
+		t.Errorf("unexpected logging config %+v", cfg.Logging)
+	}
+}
+
+func TestConfigFlagPrecedence(t *testing.T) {
+	const file = `
+generator: fake
+modes: [api]
+api:
+  listen: localhost:1234
+  token: file-token
+logging:
+  level: warn
+  format: json
+submit:
+  token: file-submit-token
+  targets:
+  - url: https://file.example.com/submit
+`
+	cfg, errs := resolveTestConfig(t, file, map[string]string{
+		"log-level":    "debug",
+		"listen-token": "flag-token",
+	})
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	// Flags override the values they set, but everything else comes from the file
+	if cfg.Logging.Level != "debug" {
+		t.Errorf("log level flag didn't override the file: %q", cfg.Logging.Level)
+	} else if cfg.Logging.Format != "json" {
+		t.Errorf("log format from the file was lost: %q", cfg.Logging.Format)
+	} else if cfg.API.Token != "flag-token" || cfg.API.Listen != "localhost:1234" {
+		t.Errorf("unexpected API config %+v", cfg.API)
+	} else if cfg.Generator != "fake" {
+		t.Errorf("generator from the file was lost: %q", cfg.Generator)
+	} else if !slices.Equal(cfg.Modes, []string{ModeAPI}) {
+		t.Errorf("modes from the file changed without mode flags: %v", cfg.Modes)
+	}
+}
+
+func TestConfigModeFlags(t *testing.T) {
+	const file = `
+modes: [relay]
+relay:
+  servers:
+  - url: https://relay.example.com
+submit:
+  interval: 10m
+  targets:
+  - url: https://file.example.com/submit
+`
+	tests := []struct {
+		name        string
+		flags       map[string]string
+		args        []string
+		wantModes   []string
+		wantTargets []string
+	}{{
+		name:        "no mode flags",
+		wantModes:   []string{ModeRelay},
+		wantTargets: []string{"https://file.example.com/submit"},
+	}, {
+		name:        "submit interval replaces modes",
+		flags:       map[string]string{"submit-interval": "5m"},
+		args:        []string{"https://flag.example.com/submit"},
+		wantModes:   []string{ModeSubmit},
+		wantTargets: []string{"https://flag.example.com/submit"},
+	}, {
+		name:        "submit and relay flags",
+		flags:       map[string]string{"submit-interval": "5m", "relay-server": "https://other.example.com"},
+		wantModes:   []string{ModeSubmit, ModeRelay},
+		wantTargets: []string{"https://file.example.com/submit"},
+	}, {
+		name:        "zero submit interval doesn't disable configured modes",
+		flags:       map[string]string{"submit-interval": "0"},
+		wantModes:   []string{ModeRelay},
+		wantTargets: []string{"https://file.example.com/submit"},
+	}, {
+		name:        "empty relay server doesn't disable configured modes",
+		flags:       map[string]string{"relay-server": ""},
+		wantModes:   []string{ModeRelay},
+		wantTargets: []string{"https://file.example.com/submit"},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, errs := resolveTestConfig(t, file, test.flags, test.args...)
+			if len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			if !slices.Equal(cfg.Modes, test.wantModes) {
+				t.Errorf("got modes %v, want %v", cfg.Modes, test.wantModes)
+			}
+			var targets []string
+			for _, target := range cfg.Submit.Targets {
+				targets = append(targets, target.URL)
+			}
+			if !slices.Equal(targets, test.wantTargets) {
+				t.Errorf("got targets %v, want %v", targets, test.wantTargets)
+			}
+		})
+	}
+}
+
+func TestConfigSubmitTargetDefaults(t *testing.T) {
+	const file = `
+modes: [submit]
+submit:
+  interval: 10m
+  token: default-token
+  targets:
+  - url: https://a.example.com
+  - url: https://b.example.com
+    interval: 1m
+    token: own-token
+  - url: https://c.example.com
+    basic_auth:
+      username: user
+      password: pass
+    hmac:
+      secret: shh
+`
+	cfg, errs := resolveTestConfig(t, file, nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	targets := cfg.Submit.Targets
+	if targets[0].Token != "default-token" || targets[0].Interval != 10*time.Minute {
+		t.Errorf("target without own settings didn't get defaults: %+v", targets[0])
+	}
+	if targets[1].Token != "own-token" || targets[1].Interval != time.Minute {
+		t.Errorf("target settings were overridden by defaults: %+v", targets[1])
+	}
+	if targets[2].Token != "" {
+		t.Errorf("target with basic auth got the default token")
+	} else if targets[2].HMAC.Header != defaultHMACHeader {
+		t.Errorf("unexpected HMAC header %q", targets[2].HMAC.Header)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		flags map[string]string
+	}{
+		{"no modes", "modes: []", nil},
+		{"unknown mode", "modes: [carrier-pigeon]", nil},
+		{"unknown generator", "generator: magic", nil},
+		{"submit without targets", "modes: [submit]\nsubmit: {interval: 5m}", nil},
+		{"api without token", "modes: [api]\napi: {listen: localhost:1234}", nil},
+		{"duplicate relay", "relay: {servers: [{url: https://a.example.com}, {url: https://a.example.com}]}", nil},
+		{"bad log level flag", "", map[string]string{"log-level": "loud"}},
+		{"fake generator with default relay", "generator: fake", nil},
+		{"fake generator with explicit default relay", "generator: fake\nrelay: {servers: [{url: " + defaultRelayServer + "}]}", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, errs := resolveTestConfig(t, test.yaml, test.flags)
+			if len(errs) == 0 {
+				t.Error("expected validation errors")
+			}
+		})
+	}
+}
+
+func TestConfigUnknownField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "provider.yaml")
+	if err := os.WriteFile(path, []byte("modez: [relay]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := *configFilePath
+	*configFilePath = path
+	defer func() { *configFilePath = oldPath }()
+	if _, err := loadProviderConfig(); err == nil {
+		t.Error("expected error for unknown field")
+	}
+	*configFilePath = filepath.Join(t.TempDir(), "missing.yaml")
+	if _, err := loadProviderConfig(); err == nil {
+		t.Error("expected error for missing explicitly specified config file")
+	}
+}
+
+func TestConfigFakeGeneratorTargets(t *testing.T) {
+	for _, yaml := range []string{
+		"generator: fake\nrelay: {servers: [{url: http://localhost:8000}]}",
+		"generator: fake\nmodes: [submit]\nsubmit: {interval: 5m, targets: [{url: http://localhost:8000/submit}]}",
+		"generator: fake\nmodes: [api]\napi: {listen: localhost:1234, token: secret}",
+	} {
+		if _, errs := resolveTestConfig(t, yaml, nil); len(errs) != 0 {
+			t.Errorf("%q: unexpected errors %v", yaml, errs)
+		}
+	}
+}
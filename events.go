@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/beeper/mac-registration-provider/nac"
+	"github.com/beeper/mac-registration-provider/versions"
+)
+
+// EventSchemaVersion is the version of the -json event stream, included in every event as "v".
+// Event types and fields may be added without changing it, but it's incremented when
+// existing types or fields are removed or change meaning.
+const EventSchemaVersion = 1
+
+// EventType is the type of an event in the -json event stream.
+type EventType string
+
+const (
+	EventStartup           EventType = "startup"
+	EventNACLoad           EventType = "nac_load"
+	EventSanityCheck       EventType = "sanity_check"
+	EventCertFetch         EventType = "cert_fetch"
+	EventRelayRegistered   EventType = "relay_registered"
+	EventRelayDisconnected EventType = "relay_disconnected"
+	EventCommand           EventType = "command"
+	EventSubmit            EventType = "submit"
+	EventShutdown          EventType = "shutdown"
+	EventFatal             EventType = "fatal"
+)
+
+// Event is a single line in the -json event stream.
+type Event struct {
+	Version int       `json:"v"`
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Data    any       `json:"data"`
+}
+
+type StartupEvent struct {
+	Commit    string            `json:"commit"`
+	Generator string            `json:"generator"`
+	Modes     []string          `json:"modes"`
+	Versions  versions.Versions `json:"versions"`
+}
+
+// ResultEvent is the data of events for steps that can fail, like loading identityservicesd.
+type ResultEvent struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type NACLoadEvent struct {
+	ResultEvent
+	// OffsetsDBVersion is the version of the offsets database that was used, or 0 if only built-in offsets were used.
+	OffsetsDBVersion int `json:"offsets_db_version,omitempty"`
+	// NoOffsets is set if the load failed because the current OS version isn't supported.
+	NoOffsets *NoOffsetsEventData `json:"no_offsets,omitempty"`
+	// ScannedOffsets is set if the offsets were found by the signature scan fallback instead of by hash.
+	ScannedOffsets *nac.IMDOffsets `json:"scanned_offsets,omitempty"`
+}
+
+type NoOffsetsEventData struct {
+	Version string `json:"version"`
+	BuildID string `json:"build_id"`
+	Arch    string `json:"arch"`
+	Hash    string `json:"hash"`
+	// ScanError is the reason the signature scan fallback failed, if it was enabled.
+	ScanError string `json:"scan_error,omitempty"`
+}
+
+type RelayRegisteredEvent struct {
+	Relay           string   `json:"relay"`
+	Code            string   `json:"code"`
+	ConfigPath      string   `json:"config_path"`
+	ProtocolVersion int      `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+}
+
+type RelayDisconnectedEvent struct {
+	Relay string `json:"relay"`
+	Error string `json:"error,omitempty"`
+	// Reconnecting is false if the provider gave up on the relay, e.g. because the registration was rejected.
+	Reconnecting bool    `json:"reconnecting"`
+	ReconnectIn  float64 `json:"reconnect_in_seconds,omitempty"`
+}
+
+type CommandEvent struct {
+	ResultEvent
+	// Source is where the command came from: relay, socket or api.
+	Source   string  `json:"source"`
+	Relay    string  `json:"relay,omitempty"`
+	Command  string  `json:"command"`
+	ReqID    int     `json:"req_id,omitempty"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+type SubmitEvent struct {
+	ResultEvent
+	Target   string  `json:"target"`
+	Attempts int     `json:"attempts"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+type ShutdownEvent struct {
+	// Clean is false if in-flight requests didn't finish before the shutdown timeout.
+	Clean bool `json:"clean"`
+}
+
+type FatalEvent struct {
+	Error string `json:"error"`
+}
+
+func resultEvent(err error) ResultEvent {
+	if err != nil {
+		return ResultEvent{OK: false, Error: err.Error()}
+	}
+	return ResultEvent{OK: true}
+}
+
+var eventLock sync.Mutex
+
+// emitEvent writes an event to stdout if -json is enabled.
+func emitEvent(eventType EventType, data any) {
+	if !*jsonOutput {
+		return
+	}
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	_ = json.NewEncoder(os.Stdout).Encode(&Event{
+		Version: EventSchemaVersion,
+		Type:    eventType,
+		Time:    time.Now().UTC(),
+		Data:    data,
+	})
+}
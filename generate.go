@@ -2,25 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/beeper/mac-registration-provider/nac"
 	"github.com/beeper/mac-registration-provider/requests"
 )
 
-var globalCert []byte
-
-func InitFetchCert(ctx context.Context) error {
-	var cancel context.CancelFunc
-	ctx, cancel = context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
-	var err error
-	globalCert, err = requests.FetchCert(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to fetch cert: %w", err)
-	}
-	return nil
+// Generator produces validation data along with the time until which it's valid.
+type Generator interface {
+	GenerateValidationData(ctx context.Context) ([]byte, time.Time, error)
 }
 
 func InitSanityCheck() error {
@@ -30,10 +24,29 @@ func InitSanityCheck() error {
 
 const ValidityTime = 15 * time.Minute
 
-func GenerateValidationData(ctx context.Context) ([]byte, time.Time, error) {
+// NACGenerator generates real validation data using the NAC functions in identityservicesd.
+// nac.Load must have been called successfully before using it.
+type NACGenerator struct {
+	cert []byte
+}
+
+var _ Generator = (*NACGenerator)(nil)
+
+func NewNACGenerator(ctx context.Context) (*NACGenerator, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	cert, err := requests.FetchCert(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch cert: %w", err)
+	}
+	return &NACGenerator{cert: cert}, nil
+}
+
+func (gen *NACGenerator) GenerateValidationData(ctx context.Context) ([]byte, time.Time, error) {
 	defer nac.MeowMemory()()
 
-	validationCtx, request, err := nac.Init(globalCert)
+	validationCtx, request, err := nac.Init(gen.cert)
 	if err != nil {
 		return nil, time.Time{}, err
 	}
@@ -56,3 +69,25 @@ func GenerateValidationData(ctx context.Context) ([]byte, time.Time, error) {
 	}
 	return validationData, validUntil, nil
 }
+
+// FakeGenerator generates deterministic dummy validation data without touching NAC or Apple's servers.
+// The nth call always returns the same bytes, which makes it usable for testing the relay and submit
+// modes on machines that can't run identityservicesd.
+type FakeGenerator struct {
+	counter atomic.Uint64
+}
+
+var _ Generator = (*FakeGenerator)(nil)
+
+const fakeDataPrefix = "mac-registration-provider fake validation data"
+
+func (gen *FakeGenerator) GenerateValidationData(ctx context.Context) ([]byte, time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+	validUntil := time.Now().UTC().Add(ValidityTime)
+	hash := sha256.New()
+	hash.Write([]byte(fakeDataPrefix))
+	_ = binary.Write(hash, binary.BigEndian, gen.counter.Add(1))
+	return hash.Sum(nil), validUntil, nil
+}
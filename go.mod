@@ -3,12 +3,22 @@ module github.com/beeper/mac-registration-provider
 go 1.21
 
 require (
+	github.com/prometheus/client_golang v1.19.1
 	github.com/tidwall/gjson v1.17.0
+	gopkg.in/yaml.v3 v3.0.1
 	howett.net/plist v1.0.0
 	nhooyr.io/websocket v1.8.10
 )
 
 require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
 )
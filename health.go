@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// providerHealth tracks the state reported by the /healthz and /readyz endpoints.
+//
+// The provider is healthy once the generator has been initialized, i.e. for the NAC generator
+// identityservicesd has been loaded, the sanity check passed and the certificate was fetched.
+// It's ready if it's healthy, the last generation attempt didn't fail and all relays are connected.
+type providerHealth struct {
+	lock sync.Mutex
+
+	generator   string
+	nacLoaded   bool
+	sanityCheck bool
+	certLoaded  bool
+
+	lastGenerationSuccess *time.Time
+	lastGenerationError   string
+	lastGenerationErrorAt *time.Time
+
+	relays map[string]*relayHealth
+}
+
+type relayHealth struct {
+	Connected      bool       `json:"connected"`
+	ConnectedSince *time.Time `json:"connected_since,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastErrorAt    *time.Time `json:"last_error_at,omitempty"`
+}
+
+type lastGenerationStatus struct {
+	SuccessAt  *time.Time `json:"success_at,omitempty"`
+	AgeSeconds *float64   `json:"age_seconds,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	ErrorAt    *time.Time `json:"error_at,omitempty"`
+}
+
+type healthResponse struct {
+	OK             bool                    `json:"ok"`
+	Problems       []string                `json:"problems,omitempty"`
+	Generator      string                  `json:"generator"`
+	NACLoaded      bool                    `json:"nac_loaded"`
+	SanityCheck    bool                    `json:"sanity_check"`
+	CertLoaded     bool                    `json:"cert_loaded"`
+	LastGeneration lastGenerationStatus    `json:"last_generation"`
+	Relays         map[string]*relayHealth `json:"relays,omitempty"`
+}
+
+var health = &providerHealth{relays: make(map[string]*relayHealth)}
+
+// setGenerator records which generator is used. The fake generator doesn't need any initialization.
+func (ph *providerHealth) setGenerator(name string) {
+	ph.lock.Lock()
+	defer ph.lock.Unlock()
+	ph.generator = name
+	if name == "fake" {
+		ph.nacLoaded, ph.sanityCheck, ph.certLoaded = true, true, true
+	}
+}
+
+func (ph *providerHealth) setNACLoaded() {
+	ph.lock.Lock()
+	ph.nacLoaded = true
+	ph.lock.Unlock()
+}
+
+func (ph *providerHealth) setSanityCheckPassed() {
+	ph.lock.Lock()
+	ph.sanityCheck = true
+	ph.lock.Unlock()
+}
+
+func (ph *providerHealth) setCertLoaded() {
+	ph.lock.Lock()
+	ph.certLoaded = true
+	ph.lock.Unlock()
+}
+
+func (ph *providerHealth) recordGeneration(err error) {
+	ph.lock.Lock()
+	defer ph.lock.Unlock()
+	now := time.Now()
+	if err != nil {
+		ph.lastGenerationError = err.Error()
+		ph.lastGenerationErrorAt = &now
+	} else {
+		ph.lastGenerationSuccess = &now
+		ph.lastGenerationError = ""
+	}
+}
+
+// addRelay registers a relay that the provider should be connected to, so it counts as not ready until it connects.
+func (ph *providerHealth) addRelay(addr string) {
+	ph.lock.Lock()
+	defer ph.lock.Unlock()
+	ph.getRelayLocked(addr)
+}
+
+func (ph *providerHealth) relayConnected(addr string) {
+	ph.lock.Lock()
+	defer ph.lock.Unlock()
+	relay := ph.getRelayLocked(addr)
+	now := time.Now()
+	relay.Connected = true
+	relay.ConnectedSince = &now
+}
+
+func (ph *providerHealth) relayDisconnected(addr string, err error) {
+	ph.lock.Lock()
+	defer ph.lock.Unlock()
+	relay := ph.getRelayLocked(addr)
+	relay.Connected = false
+	relay.ConnectedSince = nil
+	if err != nil {
+		now := time.Now()
+		relay.LastError = err.Error()
+		relay.LastErrorAt = &now
+	}
+}
+
+func (ph *providerHealth) getRelayLocked(addr string) *relayHealth {
+	relay, ok := ph.relays[addr]
+	if !ok {
+		relay = &relayHealth{}
+		ph.relays[addr] = relay
+	}
+	return relay
+}
+
+// status returns the current state, with OK set according to whether readiness or only health is being checked.
+func (ph *providerHealth) status(readiness bool) *healthResponse {
+	ph.lock.Lock()
+	defer ph.lock.Unlock()
+	resp := &healthResponse{
+		Generator:   ph.generator,
+		NACLoaded:   ph.nacLoaded,
+		SanityCheck: ph.sanityCheck,
+		CertLoaded:  ph.certLoaded,
+		LastGeneration: lastGenerationStatus{
+			SuccessAt: ph.lastGenerationSuccess,
+			Error:     ph.lastGenerationError,
+			ErrorAt:   ph.lastGenerationErrorAt,
+		},
+		Relays: make(map[string]*relayHealth, len(ph.relays)),
+	}
+	if ph.lastGenerationSuccess != nil {
+		age := time.Since(*ph.lastGenerationSuccess).Seconds()
+		resp.LastGeneration.AgeSeconds = &age
+	}
+	if !ph.nacLoaded {
+		resp.Problems = append(resp.Problems, "identityservicesd not loaded")
+	}
+	if !ph.sanityCheck {
+		resp.Problems = append(resp.Problems, "sanity check not passed")
+	}
+	if !ph.certLoaded {
+		resp.Problems = append(resp.Problems, "certificate not loaded")
+	}
+	if readiness {
+		if ph.lastGenerationError != "" {
+			resp.Problems = append(resp.Problems, "last generation failed")
+		}
+		addrs := make([]string, 0, len(ph.relays))
+		for addr := range ph.relays {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			if !ph.relays[addr].Connected {
+				resp.Problems = append(resp.Problems, "not connected to "+addr)
+			}
+		}
+	}
+	for addr, relay := range ph.relays {
+		relayCopy := *relay
+		resp.Relays[addr] = &relayCopy
+	}
+	resp.OK = len(resp.Problems) == 0
+	return resp
+}
+
+func (ph *providerHealth) makeHandler(readiness bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := ph.status(readiness)
+		status := http.StatusOK
+		if !resp.OK {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSONResponse(w, status, resp)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// setupLogging replaces the default slog logger with one using the configured level and format.
+// The standard log package also writes through the new logger after this.
+func setupLogging(cfg LoggingConfig) error {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(cfg.Level))
+	if err != nil {
+		return fmt.Errorf("invalid log level %q", cfg.Level)
+	}
+	opts := &slog.HandlerOptions{
+		Level: level,
+		// Log durations like "1.5s" in both formats instead of nanoseconds in JSON
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Value.Kind() == slog.KindDuration {
+				a.Value = slog.StringValue(a.Value.Duration().String())
+			}
+			return a
+		},
+	}
+	var handler slog.Handler
+	switch cfg.Format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs the message at error level, emits a fatal event and exits with exitCodeFatal.
+func fatal(msg string, args ...any) {
+	fatalWithCode(exitCodeFatal, msg, args...)
+}
+
+// fatalWithCode is like fatal, but exits with the given code.
+func fatalWithCode(code int, msg string, args ...any) {
+	slog.Error(msg, args...)
+	errMsg := msg
+	for i := 0; i+1 < len(args); i += 2 {
+		if args[i] == "error" {
+			errMsg = fmt.Sprintf("%s: %v", msg, args[i+1])
+		}
+	}
+	emitEvent(EventFatal, FatalEvent{Error: errMsg})
+	os.Exit(code)
+}
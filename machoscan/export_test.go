@@ -0,0 +1,4 @@
+package machoscan
+
+// MinLearnLength is exported for the external tests, which use machoscantest and so can't be in this package.
+const MinLearnLength = minLearnLength
@@ -0,0 +1,211 @@
+// Package machoscan finds the NAC function offsets in identityservicesd binaries by parsing them as Mach-O files
+// and searching for byte signatures. It's pure Go, so it can be used to analyze binaries on any OS.
+package machoscan
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Image is a single architecture of a Mach-O binary.
+type Image struct {
+	// Arch is x86 or arm64, like in the offsets tables.
+	Arch string
+	// Base is the virtual address of the __TEXT segment, which offsets are relative to.
+	Base uint64
+	// Text is the content of the __TEXT,__text section, which starts at TextOffset relative to Base.
+	Text       []byte
+	TextOffset int
+
+	file    *macho.File
+	exports []byte
+}
+
+var ErrNoText = errors.New("binary doesn't have a __TEXT,__text section")
+
+// ReadImages parses a thin or fat Mach-O binary and returns the x86 and arm64 images in it.
+func ReadImages(r io.ReaderAt) ([]*Image, error) {
+	fat, err := macho.NewFatFile(r)
+	if errors.Is(err, macho.ErrNotFat) {
+		var img *Image
+		img, err = readImage(r)
+		if err != nil {
+			return nil, err
+		}
+		return []*Image{img}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to parse fat binary: %w", err)
+	}
+	images := make([]*Image, 0, len(fat.Arches))
+	for _, arch := range fat.Arches {
+		img, err := readImage(io.NewSectionReader(r, int64(arch.Offset), int64(arch.Size)))
+		if errors.Is(err, errUnsupportedArch) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to parse %s slice: %w", arch.Cpu, err)
+		}
+		images = append(images, img)
+	}
+	if len(images) == 0 {
+		return nil, errUnsupportedArch
+	}
+	return images, nil
+}
+
+var errUnsupportedArch = errors.New("binary doesn't contain x86 or arm64 code")
+
+const (
+	loadCmdDyldInfo        macho.LoadCmd = 0x22
+	loadCmdDyldInfoOnly    macho.LoadCmd = 0x80000022
+	loadCmdDyldExportsTrie macho.LoadCmd = 0x80000033
+)
+
+func readImage(r io.ReaderAt) (*Image, error) {
+	file, err := macho.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{file: file}
+	switch file.Cpu {
+	case macho.CpuAmd64:
+		img.Arch = "x86"
+	case macho.CpuArm64:
+		img.Arch = "arm64"
+	default:
+		return nil, errUnsupportedArch
+	}
+	textSeg := file.Segment("__TEXT")
+	text := file.Section("__text")
+	if textSeg == nil || text == nil || text.Seg != "__TEXT" {
+		return nil, ErrNoText
+	}
+	img.Base = textSeg.Addr
+	img.TextOffset = int(text.Addr - img.Base)
+	img.Text, err = text.Data()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read __text section: %w", err)
+	}
+	for _, load := range file.Loads {
+		raw := load.Raw()
+		if len(raw) < 8 {
+			continue
+		}
+		var exportOff, exportSize uint32
+		switch macho.LoadCmd(file.ByteOrder.Uint32(raw)) {
+		case loadCmdDyldInfo, loadCmdDyldInfoOnly:
+			if len(raw) >= 48 {
+				exportOff, exportSize = file.ByteOrder.Uint32(raw[40:]), file.ByteOrder.Uint32(raw[44:])
+			}
+		case loadCmdDyldExportsTrie:
+			if len(raw) >= 16 {
+				exportOff, exportSize = file.ByteOrder.Uint32(raw[8:]), file.ByteOrder.Uint32(raw[12:])
+			}
+		}
+		if exportSize > 0 {
+			img.exports = make([]byte, exportSize)
+			if _, err = r.ReadAt(img.exports, int64(exportOff)); err != nil {
+				return nil, fmt.Errorf("failed to read export trie: %w", err)
+			}
+		}
+	}
+	return img, nil
+}
+
+// Bytes returns length bytes of code at the given offset, or nil if the offset isn't in the __text section.
+func (img *Image) Bytes(offset, length int) []byte {
+	start := offset - img.TextOffset
+	if start < 0 || start+length > len(img.Text) {
+		return nil
+	}
+	return img.Text[start : start+length]
+}
+
+// SymbolOffset returns the offset of an exported symbol, looking at both the symbol table and the export trie
+// used by dlsym. The name is given without the leading underscore that C symbols have,
+// but symbols without the underscore (e.g. from Go binaries) are found too.
+func (img *Image) SymbolOffset(name string) (int, bool) {
+	if img.file.Symtab != nil {
+		for _, sym := range img.file.Symtab.Syms {
+			if sym.Sect != 0 && sym.Value >= img.Base && (sym.Name == "_"+name || sym.Name == name) {
+				return int(sym.Value - img.Base), true
+			}
+		}
+	}
+	if img.exports != nil {
+		if addr, ok := lookupExport(img.exports, "_"+name); ok {
+			return int(addr), true
+		}
+	}
+	return 0, false
+}
+
+// lookupExport finds a symbol in a dyld export trie and returns its address relative to the mach header.
+// Malformed tries with empty edges or cycles are rejected rather than walked forever.
+func lookupExport(trie []byte, name string) (uint64, bool) {
+	node := uint64(0)
+	visited := make(map[uint64]bool)
+	for {
+		if node >= uint64(len(trie)) || visited[node] {
+			return 0, false
+		}
+		visited[node] = true
+		data := trie[node:]
+		terminalSize, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, false
+		}
+		data = data[n:]
+		if name == "" {
+			if terminalSize == 0 {
+				return 0, false
+			}
+			flags, n := binary.Uvarint(data)
+			if n <= 0 || flags&0x08 != 0 {
+				// Re-exports don't have an address in this binary
+				return 0, false
+			}
+			addr, n := binary.Uvarint(data[n:])
+			return addr, n > 0
+		}
+		if terminalSize > uint64(len(data)) {
+			return 0, false
+		}
+		data = data[terminalSize:]
+		if len(data) == 0 {
+			return 0, false
+		}
+		childCount := int(data[0])
+		data = data[1:]
+		found := false
+		for i := 0; i < childCount; i++ {
+			end := bytes.IndexByte(data, 0)
+			if end < 0 {
+				return 0, false
+			}
+			if end == 0 {
+				return 0, false
+			}
+			edge := string(data[:end])
+			data = data[end+1:]
+			childOffset, n := binary.Uvarint(data)
+			if n <= 0 {
+				return 0, false
+			}
+			data = data[n:]
+			if strings.HasPrefix(name, edge) {
+				name = name[len(edge):]
+				node = childOffset
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, false
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package machoscan
+
+import "testing"
+
+func TestLookupExportInvalid(t *testing.T) {
+	tries := [][]byte{
+		nil,
+		{0x80},
+		{0, 1, '_', 'a'},
+		{0, 1, '_', 'a', 0, 0x7f},
+		// An empty edge pointing back at the root
+		{0, 1, 0, 0},
+		// Edges that lead back to the root
+		{0, 1, '_', 0, 5, 0, 1, 'a', 0, 0},
+	}
+	for _, trie := range tries {
+		if _, ok := lookupExport(trie, "_a"); ok {
+			t.Errorf("lookupExport(%x) found a symbol", trie)
+		}
+	}
+}
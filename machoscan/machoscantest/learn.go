@@ -0,0 +1,43 @@
+package machoscantest
+
+import (
+	"bytes"
+	"debug/macho"
+	"testing"
+
+	"github.com/beeper/mac-registration-provider/machoscan"
+)
+
+// ExpectedOffsets returns the offsets of the NAC functions in fb, with the reference symbol at refAddr.
+func ExpectedOffsets(fb *Binary, refAddr int) *machoscan.Offsets {
+	_, funcs := fb.Layout()
+	return &machoscan.Offsets{
+		ReferenceSymbol:            ReferenceSymbol,
+		ReferenceAddress:           refAddr,
+		NACInitAddress:             funcs["NACInit"],
+		NACKeyEstablishmentAddress: funcs["NACKeyEstablishment"],
+		NACSignAddress:             funcs["NACSign"],
+	}
+}
+
+// LearnSignatures learns signatures for the given CPU from two builds with different layouts,
+// like two macOS versions.
+func LearnSignatures(t testing.TB, cpu macho.Cpu) *machoscan.ArchSignatures {
+	t.Helper()
+	var images []*machoscan.Image
+	var offsets []*machoscan.Offsets
+	for _, padding := range []int{0, 0x40} {
+		fb := &Binary{CPU: cpu, Padding: padding, Symbols: map[string]int{"_" + ReferenceSymbol: 0x800 + padding}}
+		img, err := machoscan.ReadImages(bytes.NewReader(fb.Build()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, img[0])
+		offsets = append(offsets, ExpectedOffsets(fb, 0x800+padding))
+	}
+	sigs, err := machoscan.LearnSignatures(images, offsets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sigs
+}
@@ -0,0 +1,194 @@
+// Package machoscantest builds minimal Mach-O binaries for testing code that uses machoscan.
+package machoscantest
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+)
+
+const (
+	// Base is the virtual address of the __TEXT segment of the binaries.
+	Base = 0x100000000
+	// TextOffset is the offset of the __TEXT,__text section relative to Base.
+	TextOffset = 0x1000
+	// ReferenceSymbol is the symbol that real identityservicesd offsets are relative to.
+	ReferenceSymbol = "IDSProtoKeyTransparencyTrustedServiceReadFrom"
+
+	loadCmdDyldExportsTrie macho.LoadCmd = 0x80000033
+)
+
+// Functions are the code blobs used to build binaries, keyed by arch and function name. They look like real
+// function prologues so that the signatures have to be specific enough to not match the wrong function.
+var Functions = map[string][]byte{
+	"x86/NACInit":               {0x55, 0x48, 0x89, 0xe5, 0x41, 0x57, 0x41, 0x56, 0x48, 0x81, 0xec, 0x18, 0x01, 0x00, 0x00, 0x48, 0x8d, 0x05, 0x11, 0x22, 0x33, 0x00},
+	"x86/NACKeyEstablishment":   {0x55, 0x48, 0x89, 0xe5, 0x41, 0x57, 0x41, 0x56, 0x48, 0x81, 0xec, 0x28, 0x02, 0x00, 0x00, 0x48, 0x8d, 0x05, 0x44, 0x55, 0x66, 0x00},
+	"x86/NACSign":               {0x55, 0x48, 0x89, 0xe5, 0x41, 0x57, 0x41, 0x56, 0x48, 0x81, 0xec, 0x38, 0x03, 0x00, 0x00, 0x48, 0x8d, 0x05, 0x77, 0x88, 0x99, 0x00},
+	"x86/other":                 {0x55, 0x48, 0x89, 0xe5, 0x41, 0x57, 0x41, 0x56, 0x48, 0x83, 0xec, 0x10, 0x31, 0xc0, 0x5d, 0xc3},
+	"arm64/NACInit":             {0x7f, 0x23, 0x03, 0xd5, 0xff, 0x43, 0x01, 0xd1, 0xfd, 0x7b, 0x04, 0xa9, 0x08, 0x00, 0x00, 0x90, 0x00, 0x01, 0x3f, 0xd6},
+	"arm64/NACKeyEstablishment": {0x7f, 0x23, 0x03, 0xd5, 0xff, 0x83, 0x02, 0xd1, 0xfd, 0x7b, 0x08, 0xa9, 0x09, 0x00, 0x00, 0x90, 0x20, 0x01, 0x3f, 0xd6},
+	"arm64/NACSign":             {0x7f, 0x23, 0x03, 0xd5, 0xff, 0xc3, 0x03, 0xd1, 0xfd, 0x7b, 0x0c, 0xa9, 0x0a, 0x00, 0x00, 0x90, 0x40, 0x01, 0x3f, 0xd6},
+	"arm64/other":               {0x7f, 0x23, 0x03, 0xd5, 0xff, 0x43, 0x01, 0xd1, 0xfd, 0x7b, 0x04, 0xa9, 0xc0, 0x03, 0x5f, 0xd6},
+}
+
+// Binary describes a thin Mach-O binary to build for tests.
+type Binary struct {
+	CPU macho.Cpu
+	// Padding is added to the start of the __text section, which shifts all the offsets.
+	Padding int
+	// Symbols are put in the symbol table, and Exports in the export trie. The values are relative to the image base.
+	Symbols map[string]int
+	Exports map[string]int
+}
+
+// Layout returns the code for the binary and the offsets (relative to the image base)
+// of the functions in it, with a copy of the "other" function between each one.
+func (fb *Binary) Layout() ([]byte, map[string]int) {
+	arch := "x86"
+	if fb.CPU == macho.CpuArm64 {
+		arch = "arm64"
+	}
+	code := bytes.Repeat([]byte{0}, fb.Padding)
+	offsets := make(map[string]int)
+	for _, name := range []string{"NACSign", "NACKeyEstablishment", "NACInit"} {
+		code = append(code, Functions[arch+"/other"]...)
+		offsets[name] = TextOffset + len(code)
+		code = append(code, Functions[arch+"/"+name]...)
+	}
+	code = append(code, Functions[arch+"/other"]...)
+	return code, offsets
+}
+
+// Build builds a minimal 64-bit Mach-O executable with a __TEXT segment, a symbol table and an export trie.
+func (fb *Binary) Build() []byte {
+	text, _ := fb.Layout()
+	le := binary.LittleEndian
+	var strtab bytes.Buffer
+	strtab.WriteByte(0)
+	var symtab bytes.Buffer
+	for name, offset := range fb.Symbols {
+		nlist := make([]byte, 16)
+		le.PutUint32(nlist[0:], uint32(strtab.Len()))
+		nlist[4] = 0x0f // N_SECT | N_EXT
+		nlist[5] = 1
+		le.PutUint64(nlist[8:], uint64(Base+offset))
+		symtab.Write(nlist)
+		strtab.WriteString(name)
+		strtab.WriteByte(0)
+	}
+	trie := buildExportTrie(fb.Exports)
+
+	textEnd := TextOffset + len(text)
+	symOff := (textEnd + 7) &^ 7
+	strOff := symOff + symtab.Len()
+	trieOff := strOff + strtab.Len()
+	fileSize := trieOff + len(trie)
+
+	out := make([]byte, fileSize)
+	const segCmdSize = 72 + 80
+	cmds := []int{segCmdSize, 24, 16}
+	sizeOfCmds := 0
+	for _, size := range cmds {
+		sizeOfCmds += size
+	}
+	le.PutUint32(out[0:], macho.Magic64)
+	le.PutUint32(out[4:], uint32(fb.CPU))
+	le.PutUint32(out[12:], uint32(macho.TypeExec))
+	le.PutUint32(out[16:], uint32(len(cmds)))
+	le.PutUint32(out[20:], uint32(sizeOfCmds))
+
+	seg := out[32:]
+	le.PutUint32(seg[0:], uint32(macho.LoadCmdSegment64))
+	le.PutUint32(seg[4:], segCmdSize)
+	copy(seg[8:24], "__TEXT")
+	le.PutUint64(seg[24:], Base)
+	le.PutUint64(seg[32:], uint64(textEnd))
+	le.PutUint64(seg[40:], 0)
+	le.PutUint64(seg[48:], uint64(textEnd))
+	le.PutUint32(seg[56:], 5)
+	le.PutUint32(seg[60:], 5)
+	le.PutUint32(seg[64:], 1)
+	sect := seg[72:]
+	copy(sect[0:16], "__text")
+	copy(sect[16:32], "__TEXT")
+	le.PutUint64(sect[32:], Base+TextOffset)
+	le.PutUint64(sect[40:], uint64(len(text)))
+	le.PutUint32(sect[48:], TextOffset)
+
+	symtabCmd := out[32+segCmdSize:]
+	le.PutUint32(symtabCmd[0:], uint32(macho.LoadCmdSymtab))
+	le.PutUint32(symtabCmd[4:], 24)
+	le.PutUint32(symtabCmd[8:], uint32(symOff))
+	le.PutUint32(symtabCmd[12:], uint32(len(fb.Symbols)))
+	le.PutUint32(symtabCmd[16:], uint32(strOff))
+	le.PutUint32(symtabCmd[20:], uint32(strtab.Len()))
+
+	trieCmd := out[32+segCmdSize+24:]
+	le.PutUint32(trieCmd[0:], uint32(loadCmdDyldExportsTrie))
+	le.PutUint32(trieCmd[4:], 16)
+	le.PutUint32(trieCmd[8:], uint32(trieOff))
+	le.PutUint32(trieCmd[12:], uint32(len(trie)))
+
+	copy(out[TextOffset:], text)
+	copy(out[symOff:], symtab.Bytes())
+	copy(out[strOff:], strtab.Bytes())
+	copy(out[trieOff:], trie)
+	return out
+}
+
+// buildExportTrie builds an export trie where the root node has an edge to a terminal node for each symbol.
+func buildExportTrie(exports map[string]int) []byte {
+	if len(exports) == 0 {
+		return nil
+	}
+	var terminals [][]byte
+	var names []string
+	for name, offset := range exports {
+		info := binary.AppendUvarint(nil, 0)
+		info = binary.AppendUvarint(info, uint64(offset))
+		node := binary.AppendUvarint(nil, uint64(len(info)))
+		node = append(node, info...)
+		node = append(node, 0)
+		terminals = append(terminals, node)
+		names = append(names, name)
+	}
+	rootSize := 2
+	for _, name := range names {
+		// Child offsets are assumed to fit in one byte, which is enough for tests
+		rootSize += len(name) + 1 + 1
+	}
+	root := []byte{0, byte(len(names))}
+	childOffset := rootSize
+	for i, name := range names {
+		root = append(root, name...)
+		root = append(root, 0)
+		root = binary.AppendUvarint(root, uint64(childOffset))
+		childOffset += len(terminals[i])
+	}
+	for _, node := range terminals {
+		root = append(root, node...)
+	}
+	return root
+}
+
+// BuildFat combines thin binaries into a fat binary.
+func BuildFat(cpus []macho.Cpu, thins [][]byte) []byte {
+	be := binary.BigEndian
+	const align = 0x1000
+	out := make([]byte, align)
+	be.PutUint32(out[0:], macho.MagicFat)
+	be.PutUint32(out[4:], uint32(len(thins)))
+	for i, thin := range thins {
+		offset := len(out)
+		arch := out[8+i*20:]
+		be.PutUint32(arch[0:], uint32(cpus[i]))
+		be.PutUint32(arch[8:], uint32(offset))
+		be.PutUint32(arch[12:], uint32(len(thin)))
+		be.PutUint32(arch[16:], 12)
+		out = append(out, thin...)
+		if pad := len(out) % align; pad != 0 {
+			out = append(out, make([]byte, align-pad)...)
+		}
+	}
+	return out
+}
@@ -0,0 +1,128 @@
+package machoscan
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Pattern is a byte signature where some bytes may be wildcards.
+//
+// In text form, it's a space-separated list of hex bytes where "??" matches any byte, e.g. "55 48 89 e5 ?? 57".
+type Pattern struct {
+	Bytes []byte
+	// Mask has 0xff for bytes that must match and 0x00 for wildcards.
+	Mask []byte
+}
+
+// ParsePattern parses a pattern in text form.
+func ParsePattern(text string) (Pattern, error) {
+	fields := strings.Fields(text)
+	pattern := Pattern{Bytes: make([]byte, len(fields)), Mask: make([]byte, len(fields))}
+	for i, field := range fields {
+		if field == "??" {
+			continue
+		}
+		decoded, err := hex.DecodeString(field)
+		if err != nil || len(decoded) != 1 {
+			return Pattern{}, fmt.Errorf("invalid byte %q at position %d in pattern", field, i)
+		}
+		pattern.Bytes[i] = decoded[0]
+		pattern.Mask[i] = 0xff
+	}
+	return pattern, nil
+}
+
+// MustParsePattern is like ParsePattern, but panics on error.
+func MustParsePattern(text string) Pattern {
+	pattern, err := ParsePattern(text)
+	if err != nil {
+		panic(err)
+	}
+	return pattern
+}
+
+func (p Pattern) String() string {
+	parts := make([]string, len(p.Bytes))
+	for i, b := range p.Bytes {
+		if p.Mask[i] == 0 {
+			parts[i] = "??"
+		} else {
+			parts[i] = fmt.Sprintf("%02x", b)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (p Pattern) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Pattern) UnmarshalText(text []byte) (err error) {
+	*p, err = ParsePattern(string(text))
+	return
+}
+
+// IsZero returns true if the pattern doesn't have any bytes that must match.
+func (p Pattern) IsZero() bool {
+	for _, m := range p.Mask {
+		if m != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchAt returns whether the pattern matches data at the given index.
+func (p Pattern) MatchAt(data []byte, at int) bool {
+	if at < 0 || at+len(p.Bytes) > len(data) {
+		return false
+	}
+	for i, b := range p.Bytes {
+		if data[at+i]&p.Mask[i] != b&p.Mask[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// FindAll returns the indexes where the pattern matches data.
+// If limit is positive, it stops after finding that many matches.
+func (p Pattern) FindAll(data []byte, limit int) []int {
+	if p.IsZero() {
+		return nil
+	}
+	// Use the first fixed byte as an anchor, as most positions won't have it
+	anchor := 0
+	for p.Mask[anchor] == 0 {
+		anchor++
+	}
+	var matches []int
+	for i := anchor; i <= len(data)-len(p.Bytes)+anchor; i++ {
+		if data[i] == p.Bytes[anchor] && p.MatchAt(data, i-anchor) {
+			matches = append(matches, i-anchor)
+			if limit > 0 && len(matches) >= limit {
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// commonPattern returns a pattern matching all of the given byte slices,
+// which must have the same length. Bytes that differ between the slices are wildcards.
+func commonPattern(samples [][]byte) Pattern {
+	pattern := Pattern{Bytes: make([]byte, len(samples[0])), Mask: make([]byte, len(samples[0]))}
+	copy(pattern.Bytes, samples[0])
+	for i := range pattern.Mask {
+		pattern.Mask[i] = 0xff
+		for _, sample := range samples[1:] {
+			if sample[i] != pattern.Bytes[i] {
+				pattern.Bytes[i] = 0
+				pattern.Mask[i] = 0
+				break
+			}
+		}
+	}
+	return pattern
+}
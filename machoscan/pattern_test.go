@@ -0,0 +1,73 @@
+package machoscan
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestParsePattern(t *testing.T) {
+	pattern, err := ParsePattern("55 48 ?? e5\t?? 57")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(pattern.Bytes, []byte{0x55, 0x48, 0, 0xe5, 0, 0x57}) {
+		t.Errorf("unexpected bytes %x", pattern.Bytes)
+	} else if !slices.Equal(pattern.Mask, []byte{0xff, 0xff, 0, 0xff, 0, 0xff}) {
+		t.Errorf("unexpected mask %x", pattern.Mask)
+	} else if pattern.String() != "55 48 ?? e5 ?? 57" {
+		t.Errorf("unexpected string %q", pattern.String())
+	}
+	for _, invalid := range []string{"5", "555", "zz", "?"} {
+		if _, err = ParsePattern(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestPatternJSON(t *testing.T) {
+	var sigs ArchSignatures
+	err := json.Unmarshal([]byte(`{"nac_init": "01 ?? 03", "nac_key_establishment": "04", "nac_sign": "?? 05"}`), &sigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(&sigs)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != `{"nac_init":"01 ?? 03","nac_key_establishment":"04","nac_sign":"?? 05"}` {
+		t.Errorf("unexpected JSON %s", data)
+	}
+}
+
+func TestPatternFindAll(t *testing.T) {
+	data := []byte{0x00, 0x55, 0x48, 0x89, 0xe5, 0x55, 0x48, 0x8b, 0xe5, 0x55, 0x48}
+	tests := []struct {
+		pattern string
+		limit   int
+		want    []int
+	}{
+		{"55 48 89 e5", 0, []int{1}},
+		{"55 48 ?? e5", 0, []int{1, 5}},
+		{"55 48 ?? e5", 1, []int{1}},
+		{"?? 55 48", 0, []int{0, 4, 8}},
+		{"e5 55 48 00", 0, nil},
+		{"?? ??", 0, nil},
+	}
+	for _, test := range tests {
+		got := MustParsePattern(test.pattern).FindAll(data, test.limit)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("FindAll(%q, %d) = %v, want %v", test.pattern, test.limit, got, test.want)
+		}
+	}
+}
+
+func TestCommonPattern(t *testing.T) {
+	pattern := commonPattern([][]byte{
+		{0xff, 0x43, 0x01, 0xd1, 0x10, 0x20},
+		{0xff, 0x83, 0x01, 0xd1, 0x10, 0x20},
+		{0xff, 0x43, 0x01, 0xd1, 0x10, 0x28},
+	})
+	if pattern.String() != "ff ?? 01 d1 10 ??" {
+		t.Errorf("unexpected pattern %q", pattern.String())
+	}
+}
@@ -0,0 +1,165 @@
+package machoscan
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// DefaultReferenceSymbols are the exported symbols that have been used as references in identityservicesd.
+var DefaultReferenceSymbols = []string{
+	"IDSProtoKeyTransparencyTrustedServiceReadFrom",
+	"newLocalDeliveryServiceStatString",
+}
+
+// Offsets are the offsets of the reference symbol and the NAC functions relative to the image base.
+// They have the same meaning as the fields of nac.IMDOffsets.
+type Offsets struct {
+	ReferenceSymbol            string
+	ReferenceAddress           int
+	NACInitAddress             int
+	NACKeyEstablishmentAddress int
+	NACSignAddress             int
+}
+
+// ArchSignatures are the signatures of the NAC functions on one architecture.
+// Each pattern must match exactly once, at the start of the function.
+type ArchSignatures struct {
+	// ReferenceSymbols are tried in order. DefaultReferenceSymbols are used if it's empty.
+	ReferenceSymbols    []string `json:"reference_symbols,omitempty"`
+	NACInit             Pattern  `json:"nac_init"`
+	NACKeyEstablishment Pattern  `json:"nac_key_establishment"`
+	NACSign             Pattern  `json:"nac_sign"`
+}
+
+// Signatures are the NAC function signatures for each architecture.
+type Signatures struct {
+	X86   *ArchSignatures `json:"x86,omitempty"`
+	ARM64 *ArchSignatures `json:"arm64,omitempty"`
+}
+
+// ForArch returns the signatures for the given architecture (x86 or arm64), or nil if there aren't any.
+func (sigs *Signatures) ForArch(arch string) *ArchSignatures {
+	if sigs == nil {
+		return nil
+	} else if arch == "arm64" {
+		return sigs.ARM64
+	}
+	return sigs.X86
+}
+
+var (
+	ErrNoReferenceSymbol = errors.New("none of the reference symbols were found")
+	ErrNoSignatures      = errors.New("no signatures for architecture")
+)
+
+// SignatureMatchError is returned by FindOffsets if a signature didn't match exactly once.
+type SignatureMatchError struct {
+	Function string
+	Matches  int
+}
+
+func (err SignatureMatchError) Error() string {
+	if err.Matches == 0 {
+		return fmt.Sprintf("%s signature didn't match", err.Function)
+	}
+	return fmt.Sprintf("%s signature matched %d times", err.Function, err.Matches)
+}
+
+// FindReferenceSymbol returns the first of the given symbols (or DefaultReferenceSymbols) that the image exports.
+func (img *Image) FindReferenceSymbol(symbols []string) (string, int, error) {
+	if len(symbols) == 0 {
+		symbols = DefaultReferenceSymbols
+	}
+	for _, name := range symbols {
+		if offset, ok := img.SymbolOffset(name); ok {
+			return name, offset, nil
+		}
+	}
+	return "", 0, ErrNoReferenceSymbol
+}
+
+// FindFunction returns the offset of the only place in the __text section where the pattern matches.
+func (img *Image) FindFunction(name string, pattern Pattern) (int, error) {
+	// Two matches are enough to know the signature is ambiguous
+	matches := pattern.FindAll(img.Text, 2)
+	if len(matches) != 1 {
+		return 0, SignatureMatchError{Function: name, Matches: len(matches)}
+	}
+	return img.TextOffset + matches[0], nil
+}
+
+// FindOffsets finds the reference symbol and the NAC functions in the image.
+func (img *Image) FindOffsets(sigs *ArchSignatures) (*Offsets, error) {
+	if sigs == nil {
+		return nil, fmt.Errorf("%w %s", ErrNoSignatures, img.Arch)
+	}
+	var offs Offsets
+	var err error
+	offs.ReferenceSymbol, offs.ReferenceAddress, err = img.FindReferenceSymbol(sigs.ReferenceSymbols)
+	if err != nil {
+		return nil, err
+	}
+	if offs.NACInitAddress, err = img.FindFunction("NACInit", sigs.NACInit); err != nil {
+		return nil, err
+	} else if offs.NACKeyEstablishmentAddress, err = img.FindFunction("NACKeyEstablishment", sigs.NACKeyEstablishment); err != nil {
+		return nil, err
+	} else if offs.NACSignAddress, err = img.FindFunction("NACSign", sigs.NACSign); err != nil {
+		return nil, err
+	}
+	return &offs, nil
+}
+
+const (
+	minLearnLength = 16
+	maxLearnLength = 256
+)
+
+// LearnSignatures creates signatures from images of the same architecture where the offsets are already known.
+// The bytes at the start of each function are compared between the images and the ones that differ become
+// wildcards. The signatures are made as short as possible while still matching only once in every image.
+// Using images from several OS versions makes it more likely that the signatures work for future versions too.
+func LearnSignatures(images []*Image, offsets []*Offsets) (*ArchSignatures, error) {
+	if len(images) == 0 || len(images) != len(offsets) {
+		return nil, fmt.Errorf("expected the same non-zero number of images and offsets")
+	}
+	learn := func(name string, getOffset func(offs *Offsets) int) (Pattern, error) {
+		for length := minLearnLength; length <= maxLearnLength; length *= 2 {
+			samples := make([][]byte, len(images))
+			for i, img := range images {
+				samples[i] = img.Bytes(getOffset(offsets[i]), length)
+				if samples[i] == nil {
+					return Pattern{}, fmt.Errorf("%s offset 0x%x is outside the __text section of image #%d", name, getOffset(offsets[i]), i+1)
+				}
+			}
+			pattern := commonPattern(samples)
+			unique := !pattern.IsZero()
+			for i, img := range images {
+				if !unique {
+					break
+				}
+				offset, err := img.FindFunction(name, pattern)
+				unique = err == nil && offset == getOffset(offsets[i])
+			}
+			if unique {
+				return pattern, nil
+			}
+		}
+		return Pattern{}, fmt.Errorf("couldn't find a unique %s signature in %d bytes", name, maxLearnLength)
+	}
+	sigs := &ArchSignatures{}
+	var err error
+	if sigs.NACInit, err = learn("NACInit", func(offs *Offsets) int { return offs.NACInitAddress }); err != nil {
+		return nil, err
+	} else if sigs.NACKeyEstablishment, err = learn("NACKeyEstablishment", func(offs *Offsets) int { return offs.NACKeyEstablishmentAddress }); err != nil {
+		return nil, err
+	} else if sigs.NACSign, err = learn("NACSign", func(offs *Offsets) int { return offs.NACSignAddress }); err != nil {
+		return nil, err
+	}
+	for _, offs := range offsets {
+		if !slices.Contains(sigs.ReferenceSymbols, offs.ReferenceSymbol) {
+			sigs.ReferenceSymbols = append(sigs.ReferenceSymbols, offs.ReferenceSymbol)
+		}
+	}
+	return sigs, nil
+}
@@ -0,0 +1,144 @@
+package machoscan_test
+
+import (
+	"bytes"
+	"debug/macho"
+	"errors"
+	"testing"
+
+	"github.com/beeper/mac-registration-provider/machoscan"
+	"github.com/beeper/mac-registration-provider/machoscan/machoscantest"
+)
+
+func readFixture(t *testing.T, fb *machoscantest.Binary) *machoscan.Image {
+	t.Helper()
+	images, err := machoscan.ReadImages(bytes.NewReader(fb.Build()))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(images) != 1 {
+		t.Fatalf("expected 1 image, got %d", len(images))
+	}
+	return images[0]
+}
+
+func TestReadImagesThin(t *testing.T) {
+	img := readFixture(t, &machoscantest.Binary{CPU: macho.CpuArm64})
+	if img.Arch != "arm64" {
+		t.Errorf("unexpected arch %q", img.Arch)
+	} else if img.Base != machoscantest.Base {
+		t.Errorf("unexpected base 0x%x", img.Base)
+	} else if img.TextOffset != machoscantest.TextOffset {
+		t.Errorf("unexpected text offset 0x%x", img.TextOffset)
+	}
+	if _, err := machoscan.ReadImages(bytes.NewReader([]byte("not a binary"))); err == nil {
+		t.Error("expected error for invalid binary")
+	}
+}
+
+func TestReadImagesFat(t *testing.T) {
+	x86 := &machoscantest.Binary{CPU: macho.CpuAmd64}
+	arm64 := &machoscantest.Binary{CPU: macho.CpuArm64, Padding: 0x10}
+	images, err := machoscan.ReadImages(bytes.NewReader(machoscantest.BuildFat(
+		[]macho.Cpu{macho.CpuAmd64, macho.CpuArm64},
+		[][]byte{x86.Build(), arm64.Build()},
+	)))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(images) != 2 || images[0].Arch != "x86" || images[1].Arch != "arm64" {
+		t.Fatalf("unexpected images %+v", images)
+	}
+	text, _ := arm64.Layout()
+	if !bytes.Equal(images[1].Text, text) {
+		t.Error("arm64 text doesn't match")
+	}
+}
+
+func TestSymbolOffset(t *testing.T) {
+	img := readFixture(t, &machoscantest.Binary{
+		CPU:     macho.CpuAmd64,
+		Symbols: map[string]int{"_symtabSymbol": 0x1234, "goSymbol": 0x2345},
+		Exports: map[string]int{"_exportedSymbol": 0x3456, "_otherExport": 0x4567},
+	})
+	for name, want := range map[string]int{
+		"symtabSymbol":   0x1234,
+		"goSymbol":       0x2345,
+		"exportedSymbol": 0x3456,
+		"otherExport":    0x4567,
+	} {
+		if got, ok := img.SymbolOffset(name); !ok || got != want {
+			t.Errorf("SymbolOffset(%q) = 0x%x, %t, want 0x%x", name, got, ok, want)
+		}
+	}
+	for _, name := range []string{"missing", "exported", "symtab"} {
+		if _, ok := img.SymbolOffset(name); ok {
+			t.Errorf("SymbolOffset(%q) found a symbol", name)
+		}
+	}
+}
+
+func TestFindOffsets(t *testing.T) {
+	for arch, cpu := range map[string]macho.Cpu{"x86": macho.CpuAmd64, "arm64": macho.CpuArm64} {
+		t.Run(arch, func(t *testing.T) {
+			sigs := machoscantest.LearnSignatures(t, cpu)
+			// A new build with a different layout and the reference symbol only in the export trie
+			fb := &machoscantest.Binary{CPU: cpu, Padding: 0x124, Exports: map[string]int{"_" + machoscantest.ReferenceSymbol: 0x888}}
+			offs, err := readFixture(t, fb).FindOffsets(sigs)
+			if err != nil {
+				t.Fatal(err)
+			} else if want := machoscantest.ExpectedOffsets(fb, 0x888); *offs != *want {
+				t.Errorf("got offsets %+v, want %+v", offs, want)
+			}
+		})
+	}
+}
+
+func TestFindOffsetsErrors(t *testing.T) {
+	sigs := machoscantest.LearnSignatures(t, macho.CpuAmd64)
+	withRef := &machoscantest.Binary{CPU: macho.CpuAmd64, Symbols: map[string]int{"_" + machoscantest.ReferenceSymbol: 0x800}}
+	img := readFixture(t, withRef)
+
+	if _, err := img.FindOffsets(nil); !errors.Is(err, machoscan.ErrNoSignatures) {
+		t.Errorf("expected ErrNoSignatures, got %v", err)
+	}
+	if _, err := readFixture(t, &machoscantest.Binary{CPU: macho.CpuAmd64}).FindOffsets(sigs); !errors.Is(err, machoscan.ErrNoReferenceSymbol) {
+		t.Errorf("expected ErrNoReferenceSymbol, got %v", err)
+	}
+
+	var matchErr machoscan.SignatureMatchError
+	noMatch := *sigs
+	noMatch.NACSign = machoscan.MustParsePattern("de ad be ef")
+	if _, err := img.FindOffsets(&noMatch); !errors.As(err, &matchErr) || matchErr.Function != "NACSign" || matchErr.Matches != 0 {
+		t.Errorf("expected NACSign to not match, got %v", err)
+	}
+	ambiguous := *sigs
+	// The generic prologue is at the start of every function
+	ambiguous.NACInit = machoscan.MustParsePattern("55 48 89 e5")
+	if _, err := img.FindOffsets(&ambiguous); !errors.As(err, &matchErr) || matchErr.Function != "NACInit" || matchErr.Matches != 2 {
+		t.Errorf("expected NACInit to be ambiguous, got %v", err)
+	}
+}
+
+func TestLearnSignatures(t *testing.T) {
+	sigs := machoscantest.LearnSignatures(t, macho.CpuArm64)
+	if len(sigs.ReferenceSymbols) != 1 || sigs.ReferenceSymbols[0] != machoscantest.ReferenceSymbol {
+		t.Errorf("unexpected reference symbols %v", sigs.ReferenceSymbols)
+	}
+	for name, pattern := range map[string]machoscan.Pattern{"NACInit": sigs.NACInit, "NACKeyEstablishment": sigs.NACKeyEstablishment, "NACSign": sigs.NACSign} {
+		if len(pattern.Bytes) != machoscan.MinLearnLength {
+			t.Errorf("%s signature is %d bytes, expected the minimum of %d", name, len(pattern.Bytes), machoscan.MinLearnLength)
+		}
+		// The other function copies are identical, so a signature matching them would be ambiguous
+		if machoscan.MustParsePattern(pattern.String()).MatchAt(machoscantest.Functions["arm64/other"], 0) {
+			t.Errorf("%s signature matches the other function", name)
+		}
+	}
+
+	img := readFixture(t, &machoscantest.Binary{CPU: macho.CpuArm64})
+	if _, err := machoscan.LearnSignatures([]*machoscan.Image{img}, nil); err == nil {
+		t.Error("expected error for mismatched images and offsets")
+	}
+	outside := &machoscan.Offsets{NACInitAddress: 0x10, NACKeyEstablishmentAddress: 0x10, NACSignAddress: 0x10}
+	if _, err := machoscan.LearnSignatures([]*machoscan.Image{img}, []*machoscan.Offsets{outside}); err == nil {
+		t.Error("expected error for offsets outside the __text section")
+	}
+}
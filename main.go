@@ -6,11 +6,13 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"net/url"
+	"log/slog"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/beeper/mac-registration-provider/nac"
@@ -26,125 +28,334 @@ type ReqSubmitValidationData struct {
 
 var Commit = "unknown "
 
-var submitToken = flag.String("submit-token", "", "Token to include when submitting validation data")
+const defaultRelayServer = "https://registration-relay.beeper.com"
+
+// shutdownTimeout is how long in-flight requests and submits are given to finish after SIGINT or SIGTERM.
+const shutdownTimeout = 15 * time.Second
+
+// Exit codes for wrapper scripts. They're also documented in the README.
+const (
+	// exitCodeFatal is used for unexpected fatal errors, like failing to listen on an address.
+	exitCodeFatal = 1
+	// exitCodeInvalidConfig is used if the config file or flags are invalid.
+	exitCodeInvalidConfig = 2
+	// exitCodeShutdown is used after shutting down due to SIGINT or SIGTERM.
+	exitCodeShutdown = 3
+	// exitCodeUnsupportedOS is used if there are no offsets for the current OS version.
+	exitCodeUnsupportedOS = 4
+	// exitCodeRegistrationRejected is used if a relay rejected the registration.
+	exitCodeRegistrationRejected = 10
+)
+
+// stringListFlag is a flag that can be specified multiple times.
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringListFlag) Set(val string) error {
+	*f = append(*f, val)
+	return nil
+}
+
+// NonEmpty returns the values of the flag excluding empty strings.
+func (f *stringListFlag) NonEmpty() []string {
+	out := make([]string, 0, len(*f))
+	for _, val := range *f {
+		if val != "" {
+			out = append(out, val)
+		}
+	}
+	return out
+}
+
+var configFilePath = flag.String("config-file", "", "Path to the config file (defaults to provider.yaml in the config directory)")
+var submitToken = flag.String("submit-token", "", "Token to include when submitting validation data (default for all submit targets)")
 var submitInterval = flag.Duration("submit-interval", 0, "Interval at which to submit new validation data to the server")
-var relayServer = flag.String("relay-server", "https://registration-relay.beeper.com", "URL of the relay server to use")
+var submitOutboxPath = flag.String("submit-outbox", "", "File to save undelivered validation data in, so it can be redelivered after a restart")
+var apiListen = flag.String("listen", "", "Address to serve validation data on over HTTP (enables API mode)")
+var apiToken = flag.String("listen-token", "", "Bearer token required for the HTTP API")
+var socketPath = flag.String("socket", "", "Path of a unix socket to serve validation data on (enables socket mode)")
+var socketMode = flag.String("socket-mode", "", "Octal file mode of the unix socket (defaults to 0600)")
+var socketGroup = flag.String("socket-group", "", "Group to give the unix socket to")
+var prefetch = flag.Bool("prefetch", false, "Generate validation data in the background before the cached data expires")
+var offsetsURL = flag.String("offsets-url", "", "URL to periodically fetch a signed offsets database from (defaults to disabled)")
+var offsetsFile = flag.String("offsets-file", "", "Signed offsets database to use in addition to the built-in offsets (defaults to offsets.json in the config directory if it exists)")
+var offsetsSignatureScan = flag.Bool("offsets-signature-scan", false, "Scan identityservicesd for the NAC function signatures in the offsets database if there are no offsets for the exact binary")
+var metricsListen = flag.String("metrics-listen", "", "Address to serve Prometheus metrics on (defaults to disabled)")
 var overrideConfigPath = flag.String("config-path", "", "File to save registration code in when using relay mode")
 var jsonOutput = flag.Bool("json", false, "Output JSON instead of text")
+var logLevel = flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+var logFormat = flag.String("log-format", "text", "Log format: text or json")
 var submitUserAgent = fmt.Sprintf("mac-registration-provider/%s go/%s macOS/%s", Commit[:8], strings.TrimPrefix(runtime.Version(), "go"), versions.Current.SoftwareVersion)
 var once = flag.Bool("once", false, "Generate a single validation data, print it to stdout and exit")
 var checkCompatibility = flag.Bool("check-compatibility", false, "Check if offsets for the current OS version are available and exit")
+var relayServerFlag stringListFlag
+var generatorType = flag.String("generator", "nac", "Validation data generator to use: nac (real data from identityservicesd) or fake (deterministic dummy data for testing)")
+
+func init() {
+	flag.Var(&relayServerFlag, "relay-server", "URL of the relay server to use (can be specified multiple times, defaults to "+defaultRelayServer+")")
+}
+
+var subcommands = map[string]func(args []string){
+	"serve-relay": cmdServeRelay,
+	"receive":     cmdReceive,
+	"config":      cmdConfig,
+	"offsets":     cmdOffsets,
+}
 
 func main() {
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			subcommand(os.Args[2:])
+			return
+		}
+	}
 	flag.Parse()
-	var urls []string
-	if *submitInterval > 0 {
-		urls = flag.Args()
-		if len(urls) == 0 {
-			_, _ = fmt.Fprintln(os.Stderr, "You must pass one or more URLs to submit to when using -interval")
+	cfg, err := resolveConfig()
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		os.Exit(exitCodeInvalidConfig)
+	}
+	// The rest of the program reads the JSON output flag directly
+	*jsonOutput = cfg.Logging.JSON
+	err = setupLogging(cfg.Logging)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to set up logging: %v\n", err)
+		os.Exit(exitCodeInvalidConfig)
+	}
+
+	slog.Info("Starting mac-registration-provider", "commit", Commit[:8])
+	emitEvent(EventStartup, StartupEvent{
+		Commit:    Commit,
+		Generator: cfg.Generator,
+		Modes:     cfg.Modes,
+		Versions:  versions.Current,
+	})
+	if cfg.Metrics.Listen != "" {
+		startMetricsServer(cfg.Metrics.Listen)
+	}
+	var gen Generator
+	health.setGenerator(cfg.Generator)
+	switch cfg.Generator {
+	case "nac":
+		nacGen := initNACGenerator(cfg.Offsets)
+		if nacGen == nil {
+			return
+		}
+		gen = nacGen
+	case "fake":
+		slog.Info("Using fake validation data generator")
+		// The fake generator works on any OS, so there's nothing to check
+		if *checkCompatibility {
+			slog.Info("Compatibility check successful")
 			return
 		}
-		for _, u := range urls {
-			parsedURL, err := url.Parse(u)
+		gen = &FakeGenerator{}
+	}
+	slog.Info("Initialization complete")
+	if *once {
+		validationData, validUntil, err := gen.GenerateValidationData(context.Background())
+		if err != nil {
+			fatal("Failed to generate validation data", "error", err)
+		}
+		_ = json.NewEncoder(os.Stdout).Encode(&ReqSubmitValidationData{
+			ValidationData: validationData,
+			ValidUntil:     validUntil,
+			NacservCommit:  Commit,
+			DeviceInfo:     versions.Current,
+		})
+		return
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if cfg.Cache.Prefetch {
+		go runPrefetcher(ctx, gen, cfg.Cache)
+	}
+	if cfg.Generator == "nac" && cfg.Offsets.URL != "" {
+		go runOffsetsUpdater(ctx, cfg.Offsets)
+	}
+	// All modes can run at the same time and share the validation data cache.
+	var wg sync.WaitGroup
+	if cfg.HasMode(ModeSubmit) {
+		slog.Info("Submit mode: periodically submitting validation data", "targets", len(cfg.Submit.Targets))
+		outbox, err := loadSubmitOutbox(cfg.Submit.Outbox)
+		if err != nil {
+			fatal("Failed to load submit outbox", "error", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runSubmitLoops(ctx, gen, cfg.Submit.Targets, outbox)
+		}()
+	}
+	if cfg.HasMode(ModeAPI) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runAPIServer(ctx, gen, cfg.API)
+		}()
+	}
+	if cfg.HasMode(ModeSocket) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runSocketServer(ctx, gen, cfg.Socket)
+		}()
+	}
+	if cfg.HasMode(ModeRelay) {
+		slog.Info("Relay mode: responding to requests over websocket", "relays", len(cfg.Relay.Servers))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runRelays(ctx, gen, cfg.Relay.Servers)
+		}()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return
+	case <-ctx.Done():
+	}
+	// Restore the default signal behavior, so a second signal kills the process immediately
+	stop()
+	slog.Info("Shutting down, waiting for in-flight requests to finish", "timeout", shutdownTimeout)
+	select {
+	case <-stopped:
+		slog.Info("Shutdown complete")
+		emitEvent(EventShutdown, ShutdownEvent{Clean: true})
+	case <-time.After(shutdownTimeout):
+		slog.Warn("Timed out waiting for in-flight requests to finish")
+		emitEvent(EventShutdown, ShutdownEvent{Clean: false})
+	}
+	os.Exit(exitCodeShutdown)
+}
+
+// runRelays connects to all the given relay servers and waits until all connections have stopped,
+// which happens when ctx is canceled.
+// If any of the relays gives up because of an error, the other connections are closed
+// and the process exits with the exit code for that error.
+func runRelays(ctx context.Context, gen Generator, relayServers []RelayServerConfig) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var fatalErr error
+	var fatalErrLock sync.Mutex
+	for i, server := range relayServers {
+		addr, configPath := server.URL, server.ConfigPath
+		if configPath == "" {
+			var err error
+			configPath, err = getRelayConfigPath(addr, i == 0)
 			if err != nil {
-				panic(fmt.Errorf("failed to parse input URL %q: %w", u, err))
-			} else if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
-				panic(fmt.Errorf("unexpected URL scheme %q", parsedURL.Scheme))
+				fatal("Failed to get config path", "relay", addr, "error", err)
 			}
 		}
+		health.addRelay(addr)
+		wg.Add(1)
+		go func(addr, configPath string) {
+			defer wg.Done()
+			if err := RunRelay(ctx, addr, configPath, gen); err != nil {
+				fatalErrLock.Lock()
+				if fatalErr == nil {
+					fatalErr = fmt.Errorf("%s: %w", addr, err)
+				}
+				fatalErrLock.Unlock()
+				// Don't keep serving on the other relays when the process is going to exit anyway
+				cancel()
+			}
+		}(addr, configPath)
+	}
+	wg.Wait()
+	if fatalErr != nil {
+		emitEvent(EventFatal, FatalEvent{Error: fatalErr.Error()})
+		os.Exit(relayExitCode(fatalErr))
 	}
+}
 
-	log.Printf("Starting mac-registration-provider %s", Commit[:8])
-	log.Println("Loading identityservicesd")
+// initNACGenerator loads identityservicesd, runs the sanity check and fetches the certificate.
+// It returns nil if the program should exit successfully without doing anything else (i.e. -check-compatibility).
+func initNACGenerator(offsetsCfg OffsetsConfig) *NACGenerator {
+	loadOffsetsDB(offsetsCfg)
+	nac.SignatureScanFallback = offsetsCfg.SignatureScan
+	slog.Info("Loading identityservicesd")
 	err := nac.Load()
+	var noOffsetsErr nac.NoOffsetsError
+	if errors.As(err, &noOffsetsErr) && offsetsCfg.URL != "" {
+		slog.Info("No offsets found, checking for an updated offsets database", "url", offsetsCfg.URL)
+		updated, updateErr := updateOffsetsDB(context.Background(), offsetsCfg)
+		if updateErr != nil {
+			slog.Warn("Failed to update offsets database", "error", updateErr)
+		} else if updated {
+			err = nac.Load()
+		}
+	}
+	loadedOffsetsDBVersion.Store(offsetsDBVersion.Load())
+	offsetsDBVersion := int(loadedOffsetsDBVersion.Load())
 	if err != nil {
-		var noOffsetsErr nac.NoOffsetsError
 		if errors.As(err, &noOffsetsErr) {
-			if *jsonOutput {
-				_ = json.NewEncoder(os.Stdout).Encode(map[string]any{
-					"error": "no offsets",
-					"data":  err,
-					"ok":    false,
-				})
+			emitEvent(EventNACLoad, NACLoadEvent{
+				ResultEvent:      resultEvent(err),
+				OffsetsDBVersion: offsetsDBVersion,
+				NoOffsets: &NoOffsetsEventData{
+					Version:   noOffsetsErr.Version,
+					BuildID:   noOffsetsErr.BuildID,
+					Arch:      noOffsetsErr.Arch,
+					Hash:      noOffsetsErr.Hash,
+					ScanError: noOffsetsErr.ScanError,
+				},
+			})
+			if noOffsetsErr.ScanError != "" {
+				slog.Warn("Signature scan fallback failed", "error", noOffsetsErr.ScanError)
 			}
-			log.Fatalf("No offsets found for %s/%s/%s (hash: %s)", noOffsetsErr.Version, noOffsetsErr.BuildID, noOffsetsErr.Arch, noOffsetsErr.Hash)
-			return
+			fatalWithCode(exitCodeUnsupportedOS, "No offsets found", "version", noOffsetsErr.Version, "build_id", noOffsetsErr.BuildID, "arch", noOffsetsErr.Arch, "hash", noOffsetsErr.Hash)
 		}
-		panic(err)
+		emitEvent(EventNACLoad, NACLoadEvent{ResultEvent: resultEvent(err), OffsetsDBVersion: offsetsDBVersion})
+		fatal("Failed to load identityservicesd", "error", err)
+	}
+	scanned := nac.ScannedOffsets()
+	if scanned != nil {
+		slog.Warn("Using offsets found by signature scan, please report them so they can be added to the offsets database",
+			"reference_symbol", scanned.ReferenceSymbol,
+			"reference_address", fmt.Sprintf("0x%x", scanned.ReferenceAddress),
+			"nac_init_address", fmt.Sprintf("0x%x", scanned.NACInitAddress),
+			"nac_key_establishment_address", fmt.Sprintf("0x%x", scanned.NACKeyEstablishmentAddress),
+			"nac_sign_address", fmt.Sprintf("0x%x", scanned.NACSignAddress),
+		)
 	}
-	log.Println("Running sanity check...")
+	emitEvent(EventNACLoad, NACLoadEvent{ResultEvent: resultEvent(nil), OffsetsDBVersion: offsetsDBVersion, ScannedOffsets: scanned})
+	health.setNACLoaded()
+	slog.Info("Running sanity check")
 	safetyExitCancel := make(chan struct{})
 	go func() {
 		select {
 		case <-time.After(5 * time.Second):
-			log.Fatalln("Sanity check timed out")
+			emitEvent(EventSanityCheck, ResultEvent{Error: "timed out"})
+			fatal("Sanity check timed out")
 		case <-safetyExitCancel:
 		}
 	}()
 	err = InitSanityCheck()
+	close(safetyExitCancel)
+	emitEvent(EventSanityCheck, resultEvent(err))
 	if err != nil {
-		panic(err)
+		fatal("Sanity check failed", "error", err)
 	}
-	close(safetyExitCancel)
+	health.setSanityCheckPassed()
 	if *checkCompatibility {
-		log.Println("Compatibility check successful")
-		if *jsonOutput {
-			_ = json.NewEncoder(os.Stdout).Encode(map[string]any{
-				"ok": true,
-			})
-		}
-		return
+		slog.Info("Compatibility check successful")
+		return nil
 	}
-	log.Println("Fetching certificate...")
-	err = InitFetchCert(context.Background())
+	slog.Info("Fetching certificate")
+	gen, err := NewNACGenerator(context.Background())
+	emitEvent(EventCertFetch, resultEvent(err))
 	if err != nil {
-		panic(err)
-	}
-	log.Println("Initialization complete")
-	if *once {
-		validationData, validUntil, err := GenerateValidationData(context.Background())
-		if err != nil {
-			panic(err)
-		}
-		_ = json.NewEncoder(os.Stdout).Encode(&ReqSubmitValidationData{
-			ValidationData: validationData,
-			ValidUntil:     validUntil,
-			NacservCommit:  Commit,
-			DeviceInfo:     versions.Current,
-		})
-		return
-	}
-	if *submitInterval > 0 {
-		log.Printf("Submit mode: periodically submitting validation data to %+v", urls)
-		for {
-			generateAndSubmit(urls)
-		}
-	} else if len(*relayServer) > 0 {
-		log.Printf("Relay mode: responding to requests over websocket at %s", *relayServer)
-		reconnectIn := 2 * time.Second
-		lastReconnect := time.Now()
-		for {
-			err = ConnectRelay(context.Background(), *relayServer)
-			if err == nil {
-				break
-			} else if strings.HasPrefix(err.Error(), "failed to register:") {
-				log.Printf("Error in relay connection: %v, not reconnecting", err)
-				if *jsonOutput {
-					_ = json.NewEncoder(os.Stdout).Encode(map[string]any{
-						"error": "registration rejected",
-					})
-				}
-				os.Exit(10)
-			}
-			log.Printf("Error in relay connection: %v, reconnecting in %v", err, reconnectIn)
-			time.Sleep(reconnectIn)
-			if time.Since(lastReconnect) < 5*time.Minute {
-				if reconnectIn < 1*time.Minute {
-					reconnectIn *= 2
-				}
-			} else {
-				reconnectIn = 2 * time.Second
-			}
-		}
+		fatal("Failed to fetch certificate", "error", err)
 	}
+	health.setCertLoaded()
+	return gen
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "mac_registration_provider"
+
+var (
+	metricGenerationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "generation_duration_seconds",
+		Help:      "Time taken to generate validation data",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"mode", "result"})
+	metricCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_lookups_total",
+		Help:      "Validation data cache lookups, by whether cached data could be used",
+	}, []string{"mode", "result"})
+	metricSubmissions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "submissions_total",
+		Help:      "Validation data submissions, by final outcome after retries",
+	}, []string{"target", "result"})
+	metricSubmitAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "submit_attempts_total",
+		Help:      "Individual HTTP requests made to submit targets",
+	}, []string{"target", "result"})
+	metricGenerationPanics = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "generation_panics_total",
+		Help:      "Panics recovered while generating validation data",
+	})
+	metricRelayConnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "relay_connects_total",
+		Help:      "Relay connection attempts, by outcome",
+	}, []string{"relay", "result"})
+	metricRelayReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "relay_reconnects_total",
+		Help:      "Times the relay connection was lost and retried",
+	}, []string{"relay"})
+	metricRelayConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "relay_connected",
+		Help:      "Whether the provider is currently registered with the relay",
+	}, []string{"relay"})
+	metricRelayCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "relay_commands_total",
+		Help:      "Commands received from relays, by outcome",
+	}, []string{"relay", "command", "result"})
+)
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+type metricsModeContextKey struct{}
+
+// withMetricsMode marks the context with the mode (e.g. relay or submit) that generation and cache metrics are labeled with.
+func withMetricsMode(ctx context.Context, mode string) context.Context {
+	return context.WithValue(ctx, metricsModeContextKey{}, mode)
+}
+
+func metricsMode(ctx context.Context) string {
+	mode, ok := ctx.Value(metricsModeContextKey{}).(string)
+	if !ok {
+		return "unknown"
+	}
+	return mode
+}
+
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", health.makeHandler(false))
+	mux.HandleFunc("/readyz", health.makeHandler(true))
+	slog.Info("Serving metrics and health checks", "url", fmt.Sprintf("http://%s/metrics", addr))
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			fatal("Failed to listen for metrics", "error", err)
+		}
+	}()
+}
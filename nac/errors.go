@@ -0,0 +1,21 @@
+package nac
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrUnsupportedPlatform = errors.New("NAC is only available on macOS")
+
+type NoOffsetsError struct {
+	Hash    string `json:"hash"`
+	Version string `json:"version"`
+	BuildID string `json:"build_id"`
+	Arch    string `json:"arch"`
+	// ScanError is the reason the signature scan fallback failed, if it was enabled.
+	ScanError string `json:"scan_error,omitempty"`
+}
+
+func (err NoOffsetsError) Error() string {
+	return fmt.Sprintf("no offsets for %s/%s/%s (hash: %s)", err.Version, err.BuildID, err.Arch, err.Hash)
+}
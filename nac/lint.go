@@ -0,0 +1,231 @@
+package nac
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+const (
+	// maxPlausibleAddress is the largest offset that's expected inside identityservicesd.
+	// The binary is a few megabytes, so anything larger is most likely a typo.
+	maxPlausibleAddress = 0x10000000
+	// maxNACSpread is the largest expected distance between the NAC functions,
+	// which are all in the same obfuscated blob of code.
+	maxNACSpread = 0x100000
+)
+
+type LintSeverity string
+
+const (
+	LintError   LintSeverity = "error"
+	LintWarning LintSeverity = "warning"
+)
+
+// LintIssue is a problem found in an offsets table by LintOffsets.
+type LintIssue struct {
+	Severity LintSeverity `json:"severity"`
+	// Check is a short machine-readable name of the check that found the issue, e.g. "duplicate_hash".
+	Check   string `json:"check"`
+	Hash    string `json:"hash"`
+	Comment string `json:"comment,omitempty"`
+	Arch    string `json:"arch,omitempty"`
+	Message string `json:"message"`
+}
+
+func (issue LintIssue) String() string {
+	target := issue.Hash
+	if issue.Comment != "" {
+		target = fmt.Sprintf("%s (%s)", issue.Hash, issue.Comment)
+	}
+	if issue.Arch != "" {
+		target = fmt.Sprintf("%s [%s]", target, issue.Arch)
+	}
+	return fmt.Sprintf("%s: %s: %s (%s)", issue.Severity, target, issue.Message, issue.Check)
+}
+
+// LintEntry is an entry in an offsets table to lint. A nil arch means the binary doesn't exist for that arch.
+type LintEntry struct {
+	Hash    string
+	Comment string
+	X86     *IMDOffsets
+	ARM64   *IMDOffsets
+}
+
+// BuiltinLintEntries returns the built-in offsets table in the order it's defined.
+func BuiltinLintEntries() []LintEntry {
+	entries := make([]LintEntry, len(offsetsTable))
+	for i, entry := range offsetsTable {
+		entries[i] = LintEntry{Hash: entry.hash, Comment: entry.comment}
+		if entry.offsets.x86 != (IMDOffsets{}) {
+			x86 := entry.offsets.x86
+			entries[i].X86 = &x86
+		}
+		if entry.offsets.arm64 != (IMDOffsets{}) {
+			arm64 := entry.offsets.arm64
+			entries[i].ARM64 = &arm64
+		}
+	}
+	return entries
+}
+
+// LintEntries returns the entries of an offsets database sorted by hash.
+func (db *OffsetsDB) LintEntries() []LintEntry {
+	entries := make([]LintEntry, 0, len(db.Offsets))
+	for hash, entry := range db.Offsets {
+		entries = append(entries, LintEntry{Hash: hash, Comment: entry.Comment, X86: entry.X86, ARM64: entry.ARM64})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Hash < entries[j].Hash
+	})
+	return entries
+}
+
+// LintEntriesFromJSON parses an offsets database file into entries in the order they appear in the file.
+// Unlike unmarshaling into OffsetsDB, which keeps only the last entry for each hash, it keeps every entry,
+// so that LintOffsets can report duplicate hashes. Neither the signature nor the offsets are checked.
+func LintEntriesFromJSON(data []byte) ([]LintEntry, error) {
+	var db OffsetsDB
+	if err := json.Unmarshal(data, &db); err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var entries []LintEntry
+	// Unmarshal succeeded, so the top level is known to be an object
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		} else if key != "offsets" {
+			var skip json.RawMessage
+			if err = dec.Decode(&skip); err != nil {
+				return nil, err
+			}
+			continue
+		} else if token, err := dec.Token(); err != nil {
+			return nil, err
+		} else if token == nil {
+			// "offsets": null
+			continue
+		}
+		for dec.More() {
+			hash, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			var entry OffsetsDBEntry
+			if err = dec.Decode(&entry); err != nil {
+				return nil, err
+			}
+			entries = append(entries, LintEntry{Hash: hash.(string), Comment: entry.Comment, X86: entry.X86, ARM64: entry.ARM64})
+		}
+		// Closing brace of the offsets object
+		if _, err = dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// LintOffsets checks an offsets table for mistakes that are easy to make when adding offsets by hand:
+// missing symbols or addresses, implausible addresses, duplicate hashes and entries for the same
+// macOS version that disagree with each other. Entries without any arches are allowed,
+// as they mark binaries that are known to be unsupported.
+func LintOffsets(entries []LintEntry) []LintIssue {
+	var issues []LintIssue
+	seenHashes := make(map[string]int, len(entries))
+	byComment := make(map[string]int, len(entries))
+	for i, entry := range entries {
+		report := func(severity LintSeverity, check, arch, message string, args ...any) {
+			issues = append(issues, LintIssue{
+				Severity: severity,
+				Check:    check,
+				Hash:     entry.Hash,
+				Comment:  entry.Comment,
+				Arch:     arch,
+				Message:  fmt.Sprintf(message, args...),
+			})
+		}
+		if decoded, err := hex.DecodeString(entry.Hash); err != nil || len(decoded) != 32 {
+			report(LintError, "invalid_hash", "", "hash is not a hex-encoded SHA-256 hash")
+		}
+		if prev, ok := seenHashes[entry.Hash]; ok {
+			report(LintError, "duplicate_hash", "", "hash is already listed as entry #%d", prev+1)
+		} else {
+			seenHashes[entry.Hash] = i
+		}
+		for _, arch := range []struct {
+			name string
+			offs *IMDOffsets
+		}{{"x86", entry.X86}, {"arm64", entry.ARM64}} {
+			if arch.offs != nil {
+				lintIMDOffsets(arch.name, arch.offs, func(check, message string, args ...any) {
+					report(LintError, check, arch.name, message, args...)
+				})
+			}
+		}
+		if entry.Comment == "" {
+			continue
+		} else if prev, ok := byComment[entry.Comment]; !ok {
+			byComment[entry.Comment] = i
+		} else if prevEntry := entries[prev]; prevEntry.Hash != entry.Hash {
+			for _, arch := range []struct {
+				name      string
+				prev, cur *IMDOffsets
+			}{{"x86", prevEntry.X86, entry.X86}, {"arm64", prevEntry.ARM64, entry.ARM64}} {
+				if arch.prev != nil && arch.cur != nil && *arch.prev != *arch.cur {
+					report(LintWarning, "conflicting_version", arch.name,
+						"offsets differ from %s, which has the same comment", prevEntry.Hash)
+				}
+			}
+		}
+	}
+	return issues
+}
+
+func lintIMDOffsets(arch string, offs *IMDOffsets, report func(check, message string, args ...any)) {
+	if offs.ReferenceSymbol == "" {
+		report("missing_symbol", "reference symbol is empty")
+	}
+	addrs := []struct {
+		name string
+		addr int
+	}{
+		{"reference address", offs.ReferenceAddress},
+		{"NACInit address", offs.NACInitAddress},
+		{"NACKeyEstablishment address", offs.NACKeyEstablishmentAddress},
+		{"NACSign address", offs.NACSignAddress},
+	}
+	for _, addr := range addrs {
+		if addr.addr <= 0 {
+			report("missing_address", "%s is not set", addr.name)
+		} else if addr.addr >= maxPlausibleAddress {
+			report("implausible_address", "%s 0x%x is larger than any known binary", addr.name, addr.addr)
+		}
+	}
+	nacAddrs := addrs[1:]
+	minAddr, maxAddr := nacAddrs[0].addr, nacAddrs[0].addr
+	for i, addr := range nacAddrs {
+		minAddr, maxAddr = min(minAddr, addr.addr), max(maxAddr, addr.addr)
+		for _, other := range nacAddrs[i+1:] {
+			if addr.addr == other.addr && addr.addr > 0 {
+				report("duplicate_address", "%s and %s are both 0x%x", addr.name, other.name, addr.addr)
+			}
+		}
+		// Functions are aligned to 4-byte instructions on arm64
+		if arch == "arm64" && addr.addr%4 != 0 {
+			report("misaligned_address", "%s 0x%x is not aligned to an instruction", addr.name, addr.addr)
+		}
+	}
+	if minAddr > 0 && maxAddr-minAddr > maxNACSpread {
+		report("address_spread", "NAC functions are spread over 0x%x bytes, expected them to be near each other", maxAddr-minAddr)
+	}
+	if minAddr > 0 && offs.ReferenceAddress > 0 && offs.ReferenceAddress >= minAddr && offs.ReferenceAddress <= maxAddr {
+		report("reference_position", "reference address 0x%x is between the NAC functions", offs.ReferenceAddress)
+	}
+}
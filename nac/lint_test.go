@@ -0,0 +1,201 @@
+package nac
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const (
+	testHashA = "0d9430e530bfb1eb528152e6f3d062408867bd159d54333228742dd7020312a8"
+	testHashB = "23f14e11c672c07ef5934614ae2b83b34065ffe179e4a9bcdcdf00c2b724b3df"
+)
+
+func validTestOffsets() *IMDOffsets {
+	return &IMDOffsets{
+		ReferenceSymbol:            "IDSProtoKeyTransparencyTrustedServiceReadFrom",
+		ReferenceAddress:           0x0b562c,
+		NACInitAddress:             0x41d714,
+		NACKeyEstablishmentAddress: 0x40af78,
+		NACSignAddress:             0x3e5184,
+	}
+}
+
+func checksOf(issues []LintIssue) []string {
+	checks := make([]string, len(issues))
+	for i, issue := range issues {
+		checks[i] = string(issue.Severity) + ":" + issue.Check
+	}
+	return checks
+}
+
+func TestLintBuiltinOffsets(t *testing.T) {
+	entries := BuiltinLintEntries()
+	if len(entries) != len(offsets) {
+		t.Errorf("offsets map has %d entries, but the table has %d", len(offsets), len(entries))
+	}
+	for _, issue := range LintOffsets(entries) {
+		t.Error(issue)
+	}
+}
+
+func TestLintBuiltinOffsetsHaveComments(t *testing.T) {
+	for _, entry := range offsetsTable {
+		if !strings.HasPrefix(entry.comment, "macOS ") {
+			t.Errorf("entry %s has comment %q, expected a macOS version", entry.hash, entry.comment)
+		}
+	}
+}
+
+func TestLintOffsets(t *testing.T) {
+	modified := func(fn func(offs *IMDOffsets)) *IMDOffsets {
+		offs := validTestOffsets()
+		fn(offs)
+		return offs
+	}
+	tests := []struct {
+		name    string
+		entries []LintEntry
+		want    []string
+	}{{
+		name:    "valid",
+		entries: []LintEntry{{Hash: testHashA, Comment: "macOS 14.0", X86: validTestOffsets(), ARM64: validTestOffsets()}},
+	}, {
+		name:    "unsupported binary",
+		entries: []LintEntry{{Hash: testHashA, Comment: "macOS 14.0"}},
+	}, {
+		name:    "invalid hash",
+		entries: []LintEntry{{Hash: "abcd", X86: validTestOffsets()}},
+		want:    []string{"error:invalid_hash"},
+	}, {
+		name: "missing symbol",
+		entries: []LintEntry{{Hash: testHashA, ARM64: modified(func(offs *IMDOffsets) {
+			offs.ReferenceSymbol = ""
+		})}},
+		want: []string{"error:missing_symbol"},
+	}, {
+		name: "missing address",
+		entries: []LintEntry{{Hash: testHashA, X86: modified(func(offs *IMDOffsets) {
+			offs.ReferenceAddress = 0
+		})}},
+		want: []string{"error:missing_address"},
+	}, {
+		name: "implausible address",
+		entries: []LintEntry{{Hash: testHashA, X86: modified(func(offs *IMDOffsets) {
+			offs.ReferenceAddress = 0x100000000
+		})}},
+		want: []string{"error:implausible_address"},
+	}, {
+		name: "same NAC addresses",
+		entries: []LintEntry{{Hash: testHashA, X86: modified(func(offs *IMDOffsets) {
+			offs.NACSignAddress = offs.NACInitAddress
+		})}},
+		want: []string{"error:duplicate_address"},
+	}, {
+		name: "NAC functions far apart",
+		entries: []LintEntry{{Hash: testHashA, X86: modified(func(offs *IMDOffsets) {
+			offs.NACSignAddress = 0x9e5184
+		})}},
+		want: []string{"error:address_spread"},
+	}, {
+		name: "reference address between NAC functions",
+		entries: []LintEntry{{Hash: testHashA, X86: modified(func(offs *IMDOffsets) {
+			offs.ReferenceAddress = 0x400000
+		})}},
+		want: []string{"error:reference_position"},
+	}, {
+		name: "unaligned arm64 address",
+		entries: []LintEntry{{Hash: testHashA, X86: modified(func(offs *IMDOffsets) {
+			offs.NACSignAddress++
+		}), ARM64: modified(func(offs *IMDOffsets) {
+			offs.NACSignAddress++
+		})}},
+		want: []string{"error:misaligned_address"},
+	}, {
+		name: "duplicate hash",
+		entries: []LintEntry{
+			{Hash: testHashA, Comment: "macOS 14.0", X86: validTestOffsets()},
+			{Hash: testHashA, Comment: "macOS 14.1", X86: validTestOffsets()},
+		},
+		want: []string{"error:duplicate_hash"},
+	}, {
+		name: "same version with same offsets",
+		entries: []LintEntry{
+			{Hash: testHashA, Comment: "macOS 14.0", X86: validTestOffsets()},
+			{Hash: testHashB, Comment: "macOS 14.0", X86: validTestOffsets(), ARM64: validTestOffsets()},
+		},
+	}, {
+		name: "same version with different offsets",
+		entries: []LintEntry{
+			{Hash: testHashA, Comment: "macOS 14.0", X86: validTestOffsets()},
+			{Hash: testHashB, Comment: "macOS 14.0", X86: modified(func(offs *IMDOffsets) {
+				offs.NACSignAddress += 0x10
+			})},
+		},
+		want: []string{"warning:conflicting_version"},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := checksOf(LintOffsets(test.entries))
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("got issues %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOffsetsDBLintEntries(t *testing.T) {
+	db := &OffsetsDB{Version: 1, Offsets: map[string]OffsetsDBEntry{
+		testHashB: {Comment: "macOS 14.1", ARM64: validTestOffsets()},
+		testHashA: {Comment: "macOS 14.0", X86: validTestOffsets()},
+	}}
+	entries := db.LintEntries()
+	if len(entries) != 2 || entries[0].Hash != testHashA || entries[1].Hash != testHashB {
+		t.Fatalf("unexpected entries %+v", entries)
+	} else if entries[0].ARM64 != nil || entries[1].X86 != nil {
+		t.Errorf("missing arches should be nil")
+	}
+	if issues := LintOffsets(entries); len(issues) != 0 {
+		t.Errorf("unexpected issues %v", issues)
+	}
+}
+
+func TestLintEntriesFromJSON(t *testing.T) {
+	offs, err := json.Marshal(validTestOffsets())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := fmt.Sprintf(`{
+		"version": 2,
+		"signatures": null,
+		"offsets": {
+			"%[1]s": {"comment": "macOS 14.0", "x86": %[3]s},
+			"%[2]s": {"comment": "macOS 14.1", "arm64": %[3]s},
+			"%[1]s": {"comment": "macOS 14.2", "arm64": %[3]s}
+		}
+	}`, testHashA, testHashB, offs)
+	entries, err := LintEntriesFromJSON([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var comments []string
+	for _, entry := range entries {
+		comments = append(comments, entry.Comment)
+	}
+	if strings.Join(comments, ",") != "macOS 14.0,macOS 14.1,macOS 14.2" {
+		t.Errorf("unexpected entries %v", comments)
+	}
+	if got := checksOf(LintOffsets(entries)); strings.Join(got, ",") != "error:duplicate_hash" {
+		t.Errorf("got issues %v, want duplicate_hash", got)
+	}
+
+	for _, invalid := range []string{`[]`, `{"offsets": []}`, `{"offsets": {"` + testHashA + `": 1}}`, `{"version": 1`} {
+		if _, err = LintEntriesFromJSON([]byte(invalid)); err == nil {
+			t.Errorf("%s: no error", invalid)
+		}
+	}
+	if entries, err = LintEntriesFromJSON([]byte(`{"version": 1, "offsets": null}`)); err != nil || len(entries) != 0 {
+		t.Errorf("null offsets: %v %v", entries, err)
+	}
+}
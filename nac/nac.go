@@ -1,3 +1,5 @@
+//go:build darwin
+
 package nac
 
 // TODO Should this use -fobjc-arc to enable automatic reference counting instead of NSAutoreleasePool?
@@ -36,34 +38,22 @@ func sha256sum(path string) (hash [32]byte, err error) {
 	return
 }
 
-type NoOffsetsError struct {
-	Hash    string `json:"hash"`
-	Version string `json:"version"`
-	BuildID string `json:"build_id"`
-	Arch    string `json:"arch"`
-}
-
-func (err NoOffsetsError) Error() string {
-	return fmt.Sprintf("no offsets for %s/%s/%s (hash: %s)", err.Version, err.BuildID, err.Arch, err.Hash)
-}
-
 func Load() error {
 	hash, err := sha256sum(identityservicesd)
 	if err != nil {
 		return err
 	}
-	var offs imdOffsets
-	if runtime.GOARCH == "arm64" {
-		offs = offsets[hash].arm64
-	} else {
-		offs = offsets[hash].x86
+	offs, scanned, scanErr := findOffsets(identityservicesd, hash, runtime.GOARCH)
+	if scanned {
+		scannedOffsets = &offs
 	}
 	if offs.ReferenceSymbol == "" {
 		return NoOffsetsError{
-			Hash:    hex.EncodeToString(hash[:]),
-			Version: versions.Current.SoftwareVersion,
-			BuildID: versions.Current.SoftwareBuildID,
-			Arch:    runtime.GOARCH,
+			Hash:      hex.EncodeToString(hash[:]),
+			Version:   versions.Current.SoftwareVersion,
+			BuildID:   versions.Current.SoftwareBuildID,
+			Arch:      runtime.GOARCH,
+			ScanError: scanErr,
 		}
 	}
 
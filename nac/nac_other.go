@@ -0,0 +1,36 @@
+//go:build !darwin
+
+package nac
+
+import (
+	"unsafe"
+)
+
+// Stubs for non-macOS platforms, which only exist so that the rest of the program
+// can be built and tested with a non-NAC generator.
+
+func Load() error {
+	return ErrUnsupportedPlatform
+}
+
+func MeowMemory() func() {
+	return func() {}
+}
+
+func SanityCheck() error {
+	return ErrUnsupportedPlatform
+}
+
+func Init(cert []byte) (validationCtx unsafe.Pointer, request []byte, err error) {
+	err = ErrUnsupportedPlatform
+	return
+}
+
+func KeyEstablishment(validationCtx unsafe.Pointer, response []byte) error {
+	return ErrUnsupportedPlatform
+}
+
+func Sign(validationCtx unsafe.Pointer) (validationData []byte, err error) {
+	err = ErrUnsupportedPlatform
+	return
+}
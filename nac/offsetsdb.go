@@ -0,0 +1,208 @@
+package nac
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/beeper/mac-registration-provider/machoscan"
+)
+
+// OffsetsPublicKey is the base64-encoded ed25519 public key that offsets databases must be signed with.
+// It's embedded at build time with -ldflags "-X github.com/beeper/mac-registration-provider/nac.OffsetsPublicKey=<key>".
+var OffsetsPublicKey = ""
+
+var (
+	ErrNoOffsetsPublicKey      = errors.New("no offsets database public key was embedded at build time")
+	ErrInvalidOffsetsSignature = errors.New("invalid offsets database signature")
+)
+
+// OffsetsDB is an offsets database file, which allows supporting new macOS versions without a new release.
+//
+// The file is signed with a detached ed25519 signature in a file with the same name plus ".sig",
+// which contains the signature either as raw bytes or base64.
+type OffsetsDB struct {
+	// Version is the version of the database, which is increased every time it's updated.
+	Version int `json:"version"`
+	// Offsets are the offsets keyed by the hex-encoded SHA-256 hash of the identityservicesd binary.
+	Offsets map[string]OffsetsDBEntry `json:"offsets"`
+	// Signatures are used to find offsets in binaries that aren't in Offsets if SignatureScanFallback is enabled.
+	Signatures *machoscan.Signatures `json:"signatures,omitempty"`
+}
+
+type OffsetsDBEntry struct {
+	// Comment is a human-readable description, usually the macOS version the binary is from.
+	Comment string      `json:"comment,omitempty"`
+	X86     *IMDOffsets `json:"x86,omitempty"`
+	ARM64   *IMDOffsets `json:"arm64,omitempty"`
+}
+
+type imdOffsetsJSON struct {
+	ReferenceSymbol            string `json:"reference_symbol"`
+	ReferenceAddress           string `json:"reference_address"`
+	NACInitAddress             string `json:"nac_init_address"`
+	NACKeyEstablishmentAddress string `json:"nac_key_establishment_address"`
+	NACSignAddress             string `json:"nac_sign_address"`
+}
+
+// MarshalJSON encodes the offsets with the addresses as hex strings like "0x3ac270".
+func (offs IMDOffsets) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&imdOffsetsJSON{
+		ReferenceSymbol:            offs.ReferenceSymbol,
+		ReferenceAddress:           fmt.Sprintf("0x%x", offs.ReferenceAddress),
+		NACInitAddress:             fmt.Sprintf("0x%x", offs.NACInitAddress),
+		NACKeyEstablishmentAddress: fmt.Sprintf("0x%x", offs.NACKeyEstablishmentAddress),
+		NACSignAddress:             fmt.Sprintf("0x%x", offs.NACSignAddress),
+	})
+}
+
+func (offs *IMDOffsets) UnmarshalJSON(data []byte) error {
+	var raw imdOffsetsJSON
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	parse := func(name, val string) (int, error) {
+		addr, err := strconv.ParseInt(strings.TrimPrefix(val, "0x"), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q: %w", name, val, err)
+		}
+		return int(addr), nil
+	}
+	offs.ReferenceSymbol = raw.ReferenceSymbol
+	if offs.ReferenceAddress, err = parse("reference_address", raw.ReferenceAddress); err != nil {
+		return err
+	} else if offs.NACInitAddress, err = parse("nac_init_address", raw.NACInitAddress); err != nil {
+		return err
+	} else if offs.NACKeyEstablishmentAddress, err = parse("nac_key_establishment_address", raw.NACKeyEstablishmentAddress); err != nil {
+		return err
+	} else if offs.NACSignAddress, err = parse("nac_sign_address", raw.NACSignAddress); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Validate checks that all the fields are set.
+func (offs *IMDOffsets) Validate() error {
+	if offs.ReferenceSymbol == "" {
+		return fmt.Errorf("missing reference symbol")
+	} else if offs.ReferenceAddress <= 0 || offs.NACInitAddress <= 0 || offs.NACKeyEstablishmentAddress <= 0 || offs.NACSignAddress <= 0 {
+		return fmt.Errorf("addresses must be positive")
+	}
+	return nil
+}
+
+// ReadOffsetsDB reads an offsets database and its signature from path and path + ".sig",
+// and verifies the signature against OffsetsPublicKey.
+func ReadOffsetsDB(path string) (*OffsetsDB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := os.ReadFile(path + ".sig")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature: %w", err)
+	}
+	return ParseOffsetsDB(data, signature)
+}
+
+// ParseOffsetsDB verifies the signature of an offsets database against OffsetsPublicKey and parses it.
+func ParseOffsetsDB(data, signature []byte) (*OffsetsDB, error) {
+	if OffsetsPublicKey == "" {
+		return nil, ErrNoOffsetsPublicKey
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(OffsetsPublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid embedded offsets database public key")
+	}
+	if len(signature) != ed25519.SignatureSize {
+		signature, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: not raw bytes or base64", ErrInvalidOffsetsSignature)
+		}
+	}
+	if !ed25519.Verify(publicKey, data, signature) {
+		return nil, ErrInvalidOffsetsSignature
+	}
+	var db OffsetsDB
+	err = json.Unmarshal(data, &db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse offsets database: %w", err)
+	} else if db.Version < 1 {
+		return nil, fmt.Errorf("invalid offsets database version %d", db.Version)
+	}
+	for hash, entry := range db.Offsets {
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("invalid hash %q in offsets database", hash)
+		}
+		for arch, offs := range map[string]*IMDOffsets{"x86": entry.X86, "arm64": entry.ARM64} {
+			if offs == nil {
+				continue
+			} else if err = offs.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid %s offsets for %s in offsets database: %w", arch, hash, err)
+			}
+		}
+	}
+	if db.Signatures != nil {
+		for arch, sigs := range map[string]*machoscan.ArchSignatures{"x86": db.Signatures.X86, "arm64": db.Signatures.ARM64} {
+			if sigs != nil && (sigs.NACInit.IsZero() || sigs.NACKeyEstablishment.IsZero() || sigs.NACSign.IsZero()) {
+				return nil, fmt.Errorf("empty %s signatures in offsets database", arch)
+			}
+		}
+	}
+	return &db, nil
+}
+
+var offsetsLock sync.RWMutex
+
+// UseOffsetsDB merges the offsets in the database over the built-in offsets.
+//
+// Offsets from the database take precedence over built-in offsets for the same hash and architecture,
+// so that incorrect built-in offsets can be fixed. Built-in offsets for architectures that the database
+// entry doesn't have are kept. Signatures in the database replace previous ones.
+// It must be called before Load to have any effect.
+func UseOffsetsDB(db *OffsetsDB) {
+	offsetsLock.Lock()
+	defer offsetsLock.Unlock()
+	if db.Signatures != nil {
+		signatures = db.Signatures
+	}
+	for hash, entry := range db.Offsets {
+		key := hexToByte32(hash)
+		tuple := offsets[key]
+		if entry.X86 != nil {
+			tuple.x86 = *entry.X86
+		}
+		if entry.ARM64 != nil {
+			tuple.arm64 = *entry.ARM64
+		}
+		offsets[key] = tuple
+	}
+}
+
+// getOffsets returns the offsets for the identityservicesd binary with the given hash on the given architecture.
+func getOffsets(hash [32]byte, arch string) IMDOffsets {
+	offsetsLock.RLock()
+	defer offsetsLock.RUnlock()
+	if arch == "arm64" {
+		return offsets[hash].arm64
+	}
+	return offsets[hash].x86
+}
+
+// KnownOffsets returns the built-in or database offsets for the identityservicesd binary with the given
+// hex-encoded hash on the given architecture (x86 or arm64).
+func KnownOffsets(hash string, arch string) (IMDOffsets, bool) {
+	if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != 32 {
+		return IMDOffsets{}, false
+	}
+	offs := getOffsets(hexToByte32(hash), arch)
+	return offs, offs.ReferenceSymbol != ""
+}
@@ -0,0 +1,191 @@
+package nac
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testHash14_6 is the hash of the 14.6 beta 1 binary, which has built-in offsets for both architectures.
+const testHash14_6 = "8eb0048ced3801d71a89495dcab198f038cd35c378ee059c52264c7b4107daa1"
+
+const testOffsetsDB = `{
+	"version": 3,
+	"offsets": {
+		"8eb0048ced3801d71a89495dcab198f038cd35c378ee059c52264c7b4107daa1": {
+			"comment": "macOS 14.6 Beta 1 (fixed)",
+			"x86": {
+				"reference_symbol": "IDSProtoKeyTransparencyTrustedServiceReadFrom",
+				"reference_address": "0xd6179",
+				"nac_init_address": "0x5586d0",
+				"nac_key_establishment_address": "0x538710",
+				"nac_sign_address": "0x54ba00"
+			}
+		},
+		"1111111111111111111111111111111111111111111111111111111111111111": {
+			"comment": "macOS 99.0",
+			"arm64": {
+				"reference_symbol": "IDSProtoKeyTransparencyTrustedServiceReadFrom",
+				"reference_address": "0xbf408",
+				"nac_init_address": "0x4c1cac",
+				"nac_key_establishment_address": "0x4af510",
+				"nac_sign_address": "0x48971c"
+			}
+		}
+	}
+}`
+
+func generateTestKey(t *testing.T) (string, ed25519.PrivateKey) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(publicKey), privateKey
+}
+
+// useTestPublicKey sets OffsetsPublicKey for the duration of the test.
+func useTestPublicKey(t *testing.T, key string) {
+	t.Helper()
+	oldKey := OffsetsPublicKey
+	OffsetsPublicKey = key
+	t.Cleanup(func() { OffsetsPublicKey = oldKey })
+}
+
+func TestParseOffsetsDBSignature(t *testing.T) {
+	publicKey, privateKey := generateTestKey(t)
+	otherPublicKey, otherPrivateKey := generateTestKey(t)
+	data := []byte(testOffsetsDB)
+	rawSignature := ed25519.Sign(privateKey, data)
+	base64Signature := []byte(base64.StdEncoding.EncodeToString(rawSignature) + "\n")
+	tampered := []byte(testOffsetsDB[:len(testOffsetsDB)-2] + ", \"extra\": 1}")
+
+	tests := []struct {
+		name      string
+		publicKey string
+		data      []byte
+		signature []byte
+		wantErr   error
+	}{
+		{"raw signature", publicKey, data, rawSignature, nil},
+		{"base64 signature", publicKey, data, base64Signature, nil},
+		{"tampered data", publicKey, tampered, rawSignature, ErrInvalidOffsetsSignature},
+		{"signed with other key", publicKey, data, ed25519.Sign(otherPrivateKey, data), ErrInvalidOffsetsSignature},
+		{"wrong public key", otherPublicKey, data, rawSignature, ErrInvalidOffsetsSignature},
+		{"garbage signature", publicKey, data, []byte("not a signature"), ErrInvalidOffsetsSignature},
+		{"empty signature", publicKey, data, nil, ErrInvalidOffsetsSignature},
+		{"no public key", "", data, rawSignature, ErrNoOffsetsPublicKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestPublicKey(t, test.publicKey)
+			db, err := ParseOffsetsDB(test.data, test.signature)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			} else if err == nil && (db.Version != 3 || len(db.Offsets) != 2) {
+				t.Errorf("unexpected database %+v", db)
+			}
+		})
+	}
+
+	for _, invalidKey := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("too short"))} {
+		useTestPublicKey(t, invalidKey)
+		if _, err := ParseOffsetsDB(data, rawSignature); err == nil {
+			t.Errorf("invalid public key %q was accepted", invalidKey)
+		}
+	}
+}
+
+func TestParseOffsetsDBContent(t *testing.T) {
+	publicKey, privateKey := generateTestKey(t)
+	useTestPublicKey(t, publicKey)
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not json", `{"version": 1,`},
+		{"no version", `{"offsets": {}}`},
+		{"invalid hash", `{"version": 1, "offsets": {"abcd": {}}}`},
+		{"missing address", `{"version": 1, "offsets": {"` + testHashA + `": {"x86": {"reference_symbol": "sym", "reference_address": "0x1"}}}}`},
+		{"empty signatures", `{"version": 1, "offsets": {}, "signatures": {"x86": {"nac_init": "55"}}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The signature is valid, so the error must come from the content
+			if _, err := ParseOffsetsDB([]byte(test.data), ed25519.Sign(privateKey, []byte(test.data))); err == nil {
+				t.Error("invalid database was accepted")
+			} else if errors.Is(err, ErrInvalidOffsetsSignature) {
+				t.Errorf("unexpected signature error: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadOffsetsDB(t *testing.T) {
+	publicKey, privateKey := generateTestKey(t)
+	useTestPublicKey(t, publicKey)
+	path := filepath.Join(t.TempDir(), "offsets.json")
+	if err := os.WriteFile(path, []byte(testOffsetsDB), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadOffsetsDB(path); err == nil {
+		t.Error("database without signature file was accepted")
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(testOffsetsDB)))
+	if err := os.WriteFile(path+".sig", []byte(signature), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if db, err := ReadOffsetsDB(path); err != nil {
+		t.Fatal(err)
+	} else if db.Version != 3 {
+		t.Errorf("unexpected version %d", db.Version)
+	}
+	if _, err := ReadOffsetsDB(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing database returned %v", err)
+	}
+}
+
+func TestUseOffsetsDBPrecedence(t *testing.T) {
+	publicKey, privateKey := generateTestKey(t)
+	useTestPublicKey(t, publicKey)
+	db, err := ParseOffsetsDB([]byte(testOffsetsDB), ed25519.Sign(privateKey, []byte(testOffsetsDB)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const newHash = "1111111111111111111111111111111111111111111111111111111111111111"
+	builtinARM64, _ := KnownOffsets(testHash14_6, "arm64")
+	if _, ok := KnownOffsets(newHash, "arm64"); ok {
+		t.Fatal("test hash unexpectedly has built-in offsets")
+	}
+
+	offsetsLock.Lock()
+	oldOffsets, oldSignatures := offsets, signatures
+	offsets = makeOffsetsMap(offsetsTable)
+	offsetsLock.Unlock()
+	t.Cleanup(func() {
+		offsetsLock.Lock()
+		offsets, signatures = oldOffsets, oldSignatures
+		offsetsLock.Unlock()
+	})
+	UseOffsetsDB(db)
+
+	// The database entry replaces the built-in x86 offsets for the same hash...
+	if x86, ok := KnownOffsets(testHash14_6, "x86"); !ok || x86 != *db.Offsets[testHash14_6].X86 {
+		t.Errorf("database didn't override built-in x86 offsets: %+v", x86)
+	}
+	// ...but the built-in arm64 offsets, which the database entry doesn't have, are kept
+	if arm64, ok := KnownOffsets(testHash14_6, "arm64"); !ok || arm64 != builtinARM64 {
+		t.Errorf("built-in arm64 offsets were lost: %+v", arm64)
+	}
+	// New hashes are added only for the architectures in the database
+	if arm64, ok := KnownOffsets(newHash, "arm64"); !ok || arm64 != *db.Offsets[newHash].ARM64 {
+		t.Errorf("new arm64 offsets weren't added: %+v", arm64)
+	}
+	if _, ok := KnownOffsets(newHash, "x86"); ok {
+		t.Error("new hash got x86 offsets that aren't in the database")
+	}
+}
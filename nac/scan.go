@@ -0,0 +1,131 @@
+package nac
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/beeper/mac-registration-provider/machoscan"
+)
+
+// SignatureScanFallback makes Load scan identityservicesd for signatures of the NAC functions
+// when there are no offsets for its exact hash. This allows point releases with identical NAC code
+// to work without new offsets. The signatures come from the offsets database, or the built-in ones
+// if it doesn't have any.
+var SignatureScanFallback = false
+
+var ErrNoSignatures = errors.New("no signatures in offsets database or built in")
+
+// signatures are the NAC function signatures from the offsets database, protected by offsetsLock.
+var signatures *machoscan.Signatures
+
+// builtinSignaturesJSON is the output of `offsets signatures` for the identityservicesd binaries
+// that have built-in offsets. It has to be regenerated when offsets for a new version are added.
+//
+//go:embed builtin_signatures.json
+var builtinSignaturesJSON []byte
+
+// builtinSignatures are used when the offsets database doesn't have signatures, protected by offsetsLock.
+var builtinSignatures = parseBuiltinSignatures(builtinSignaturesJSON)
+
+func parseBuiltinSignatures(data []byte) *machoscan.Signatures {
+	var sigs machoscan.Signatures
+	if err := json.Unmarshal(data, &sigs); err != nil {
+		panic(fmt.Errorf("invalid built-in signatures: %w", err))
+	} else if sigs.X86 == nil && sigs.ARM64 == nil {
+		return nil
+	}
+	for arch, archSigs := range map[string]*machoscan.ArchSignatures{"x86": sigs.X86, "arm64": sigs.ARM64} {
+		if archSigs != nil && (archSigs.NACInit.IsZero() || archSigs.NACKeyEstablishment.IsZero() || archSigs.NACSign.IsZero()) {
+			panic(fmt.Errorf("empty %s built-in signatures", arch))
+		}
+	}
+	return &sigs
+}
+
+// Signatures returns the NAC function signatures from the offsets database in use, or the built-in
+// signatures if it doesn't have any. It returns nil if there are no signatures at all.
+func Signatures() *machoscan.Signatures {
+	offsetsLock.RLock()
+	defer offsetsLock.RUnlock()
+	return currentSignatures()
+}
+
+// currentSignatures is Signatures without locking, offsetsLock must be held.
+func currentSignatures() *machoscan.Signatures {
+	if signatures != nil {
+		return signatures
+	}
+	return builtinSignatures
+}
+
+var scannedOffsets *IMDOffsets
+
+// ScannedOffsets returns the offsets that Load found with the signature scan fallback,
+// or nil if the offsets were found by hash.
+func ScannedOffsets() *IMDOffsets {
+	return scannedOffsets
+}
+
+// findOffsets returns the offsets for the binary at path with the given hash, or if there are none and
+// SignatureScanFallback is enabled, the offsets found by scanning it. scanned is true if the offsets were
+// found by scanning. If no offsets were found, scanErr is why the scan failed (or empty if it's disabled).
+func findOffsets(path string, hash [32]byte, goarch string) (offs IMDOffsets, scanned bool, scanErr string) {
+	offs = getOffsets(hash, goarch)
+	if offs.ReferenceSymbol != "" || !SignatureScanFallback {
+		return offs, false, ""
+	}
+	offs, err := scanOffsets(path, goarch)
+	if err != nil {
+		return IMDOffsets{}, false, err.Error()
+	}
+	return offs, true, ""
+}
+
+// scanOffsets finds the offsets in the binary at path for the given GOARCH using the signatures
+// from the offsets database, or the built-in signatures if it doesn't have any.
+func scanOffsets(path, goarch string) (IMDOffsets, error) {
+	arch := "x86"
+	if goarch == "arm64" {
+		arch = "arm64"
+	}
+	offsetsLock.RLock()
+	sigs := currentSignatures().ForArch(arch)
+	offsetsLock.RUnlock()
+	if sigs == nil {
+		return IMDOffsets{}, ErrNoSignatures
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return IMDOffsets{}, err
+	}
+	defer file.Close()
+	images, err := machoscan.ReadImages(file)
+	if err != nil {
+		return IMDOffsets{}, fmt.Errorf("failed to parse binary: %w", err)
+	}
+	for _, img := range images {
+		if img.Arch != arch {
+			continue
+		}
+		found, err := img.FindOffsets(sigs)
+		if err != nil {
+			return IMDOffsets{}, err
+		}
+		offs := IMDOffsets(*found)
+		// Don't trust signature matches that don't look like a real set of NAC functions
+		var lintErr error
+		lintIMDOffsets(arch, &offs, func(check, message string, args ...any) {
+			if lintErr == nil {
+				lintErr = fmt.Errorf("implausible offsets found: "+message, args...)
+			}
+		})
+		if lintErr != nil {
+			return IMDOffsets{}, lintErr
+		}
+		return offs, nil
+	}
+	return IMDOffsets{}, fmt.Errorf("binary doesn't contain %s code", arch)
+}
@@ -0,0 +1,205 @@
+package nac
+
+import (
+	"debug/macho"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/beeper/mac-registration-provider/machoscan"
+	"github.com/beeper/mac-registration-provider/machoscan/machoscantest"
+)
+
+// learnTestSignatures learns signatures for both arches.
+func learnTestSignatures(t *testing.T) *machoscan.Signatures {
+	t.Helper()
+	return &machoscan.Signatures{
+		X86:   machoscantest.LearnSignatures(t, macho.CpuAmd64),
+		ARM64: machoscantest.LearnSignatures(t, macho.CpuArm64),
+	}
+}
+
+func expectedTestOffsets(fb *machoscantest.Binary, refAddr int) *IMDOffsets {
+	return (*IMDOffsets)(machoscantest.ExpectedOffsets(fb, refAddr))
+}
+
+// useTestSignatures replaces the signatures from the offsets database for the duration of the test.
+func useTestSignatures(t *testing.T, sigs *machoscan.Signatures, scanFallback bool) {
+	t.Helper()
+	offsetsLock.Lock()
+	oldSignatures, oldScanFallback := signatures, SignatureScanFallback
+	signatures, SignatureScanFallback = sigs, scanFallback
+	offsetsLock.Unlock()
+	t.Cleanup(func() {
+		offsetsLock.Lock()
+		signatures, SignatureScanFallback = oldSignatures, oldScanFallback
+		offsetsLock.Unlock()
+	})
+}
+
+// useTestBuiltinSignatures replaces the built-in signatures for the duration of the test.
+func useTestBuiltinSignatures(t *testing.T, sigs *machoscan.Signatures) {
+	t.Helper()
+	offsetsLock.Lock()
+	oldBuiltinSignatures := builtinSignatures
+	builtinSignatures = sigs
+	offsetsLock.Unlock()
+	t.Cleanup(func() {
+		offsetsLock.Lock()
+		builtinSignatures = oldBuiltinSignatures
+		offsetsLock.Unlock()
+	})
+}
+
+func writeTestBinary(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "identityservicesd")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestScanOffsets(t *testing.T) {
+	sigs := learnTestSignatures(t)
+	// A new build of each arch with a different layout, combined into a fat binary like the real one
+	x86 := &machoscantest.Binary{CPU: macho.CpuAmd64, Padding: 0x124, Exports: map[string]int{"_" + machoscantest.ReferenceSymbol: 0x888}}
+	arm64 := &machoscantest.Binary{CPU: macho.CpuArm64, Padding: 0x2c, Exports: map[string]int{"_" + machoscantest.ReferenceSymbol: 0x990}}
+	fat := writeTestBinary(t, machoscantest.BuildFat(
+		[]macho.Cpu{macho.CpuAmd64, macho.CpuArm64},
+		[][]byte{x86.Build(), arm64.Build()},
+	))
+
+	tests := []struct {
+		name    string
+		goarch  string
+		sigs    *machoscan.Signatures
+		builtin *machoscan.Signatures
+		want    *IMDOffsets
+	}{
+		{"amd64", "amd64", sigs, nil, expectedTestOffsets(x86, 0x888)},
+		{"arm64", "arm64", sigs, nil, expectedTestOffsets(arm64, 0x990)},
+		{"built-in amd64", "amd64", nil, sigs, expectedTestOffsets(x86, 0x888)},
+		{"built-in arm64", "arm64", nil, sigs, expectedTestOffsets(arm64, 0x990)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestSignatures(t, test.sigs, false)
+			useTestBuiltinSignatures(t, test.builtin)
+			offs, err := scanOffsets(fat, test.goarch)
+			if err != nil {
+				t.Fatal(err)
+			} else if offs != *test.want {
+				t.Errorf("got offsets %+v, want %+v", offs, test.want)
+			}
+		})
+	}
+}
+
+func TestScanOffsetsErrors(t *testing.T) {
+	sigs := learnTestSignatures(t)
+	thinX86 := writeTestBinary(t, (&machoscantest.Binary{
+		CPU: macho.CpuAmd64, Symbols: map[string]int{"_" + machoscantest.ReferenceSymbol: 0x800},
+	}).Build())
+	// The signatures match, but the reference symbol is between the NAC functions
+	implausible := writeTestBinary(t, (&machoscantest.Binary{
+		CPU: macho.CpuArm64, Symbols: map[string]int{"_" + machoscantest.ReferenceSymbol: machoscantest.TextOffset + 0x20},
+	}).Build())
+
+	tests := []struct {
+		name    string
+		sigs    *machoscan.Signatures
+		path    string
+		goarch  string
+		wantErr string
+	}{
+		{"no signatures", nil, thinX86, "amd64", ErrNoSignatures.Error()},
+		{"no signatures for arch", &machoscan.Signatures{X86: sigs.X86}, thinX86, "arm64", ErrNoSignatures.Error()},
+		{"missing arch", sigs, thinX86, "arm64", "binary doesn't contain arm64 code"},
+		{"no reference symbol", sigs, writeTestBinary(t, (&machoscantest.Binary{CPU: macho.CpuAmd64}).Build()), "amd64", machoscan.ErrNoReferenceSymbol.Error()},
+		{"implausible offsets", sigs, implausible, "arm64", "implausible offsets found"},
+		{"not a binary", sigs, writeTestBinary(t, []byte("#!/bin/sh")), "amd64", "failed to parse binary"},
+		{"missing file", sigs, filepath.Join(t.TempDir(), "missing"), "amd64", "no such file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestSignatures(t, test.sigs, false)
+			useTestBuiltinSignatures(t, nil)
+			if _, err := scanOffsets(test.path, test.goarch); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestFindOffsetsFallback(t *testing.T) {
+	sigs := learnTestSignatures(t)
+	fb := &machoscantest.Binary{CPU: macho.CpuArm64, Padding: 0x2c, Exports: map[string]int{"_" + machoscantest.ReferenceSymbol: 0x990}}
+	path := writeTestBinary(t, fb.Build())
+	knownHash := hexToByte32(testHash14_6)
+	builtin := getOffsets(knownHash, "arm64")
+	var unknownHash [32]byte
+
+	tests := []struct {
+		name         string
+		hash         [32]byte
+		scanFallback bool
+		sigs         *machoscan.Signatures
+		want         IMDOffsets
+		wantScanned  bool
+		wantScanErr  string
+	}{
+		{"known hash", knownHash, true, sigs, builtin, false, ""},
+		{"unknown hash without fallback", unknownHash, false, sigs, IMDOffsets{}, false, ""},
+		{"unknown hash with fallback", unknownHash, true, sigs, *expectedTestOffsets(fb, 0x990), true, ""},
+		{"fallback without signatures", unknownHash, true, nil, IMDOffsets{}, false, ErrNoSignatures.Error()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestSignatures(t, test.sigs, test.scanFallback)
+			useTestBuiltinSignatures(t, nil)
+			offs, scanned, scanErr := findOffsets(path, test.hash, "arm64")
+			if offs != test.want || scanned != test.wantScanned || scanErr != test.wantScanErr {
+				t.Errorf("got %+v, %t, %q, want %+v, %t, %q", offs, scanned, scanErr, test.want, test.wantScanned, test.wantScanErr)
+			}
+		})
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	sigs := learnTestSignatures(t)
+	builtin := &machoscan.Signatures{X86: sigs.X86}
+	useTestBuiltinSignatures(t, builtin)
+
+	useTestSignatures(t, nil, false)
+	if got := Signatures(); got != builtin {
+		t.Errorf("got %+v without database signatures, want the built-in ones", got)
+	}
+	// Signatures in the database replace the built-in ones entirely, even for arches they don't have
+	useTestSignatures(t, &machoscan.Signatures{ARM64: sigs.ARM64}, false)
+	if got := Signatures(); got.X86 != nil || got.ARM64 != sigs.ARM64 {
+		t.Errorf("got %+v with database signatures", got)
+	}
+	useTestBuiltinSignatures(t, nil)
+	useTestSignatures(t, nil, false)
+	if got := Signatures(); got != nil {
+		t.Errorf("got %+v without any signatures", got)
+	}
+}
+
+func TestParseBuiltinSignatures(t *testing.T) {
+	if sigs := parseBuiltinSignatures([]byte("{}")); sigs != nil {
+		t.Errorf("got %+v from an empty file", sigs)
+	}
+	sigs := parseBuiltinSignatures([]byte(`{"arm64": {"nac_init": "ff 43", "nac_key_establishment": "7f 23", "nac_sign": "ff c3"}}`))
+	if sigs.ForArch("x86") != nil || sigs.ForArch("arm64").NACSign.String() != "ff c3" {
+		t.Errorf("unexpected signatures %+v", sigs)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic with empty signatures")
+		}
+	}()
+	parseBuiltinSignatures([]byte(`{"x86": {"nac_init": "55 48"}}`))
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/beeper/mac-registration-provider/nac"
+)
+
+const (
+	defaultOffsetsDBName   = "offsets.json"
+	offsetsCacheName       = "offsets-cache.json"
+	offsetsFetchTimeout    = 30 * time.Second
+	maxOffsetsDBSize       = 16 * 1024 * 1024
+	offsetsUpdateRetryTime = 10 * time.Minute
+)
+
+// offsetsDBVersion is the version of the newest offsets database merged over the built-in offsets,
+// or 0 if only built-in offsets are used. It includes databases downloaded after identityservicesd was loaded.
+var offsetsDBVersion atomic.Int64
+
+// loadedOffsetsDBVersion is the value of offsetsDBVersion when identityservicesd was loaded, i.e. the version
+// of the database whose offsets are actually in use. It's reported in get-version-info responses.
+var loadedOffsetsDBVersion atomic.Int64
+
+// getOffsetsDBPath returns the path of the offsets database to load.
+func getOffsetsDBPath(cfg OffsetsConfig) (string, error) {
+	if cfg.File != "" {
+		return cfg.File, nil
+	}
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, defaultOffsetsDBName), nil
+}
+
+// getOffsetsCachePath returns where databases downloaded from the update URL are cached.
+// It's separate from the database file, so that updates never overwrite a file provided by the user.
+func getOffsetsCachePath() (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, offsetsCacheName), nil
+}
+
+// loadOffsetsDB loads the offsets database and the cached update (if there are any)
+// and merges the newer one over the built-in offsets.
+// An explicitly configured file must load successfully, while problems with the file in the config directory
+// or the cache are only logged, as the built-in offsets may still work.
+func loadOffsetsDB(cfg OffsetsConfig) {
+	path, err := getOffsetsDBPath(cfg)
+	if err != nil {
+		slog.Warn("Failed to get config dir to look for offsets database", "error", err)
+		return
+	}
+	explicit := cfg.File != ""
+	db, err := nac.ReadOffsetsDB(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		// No database file, which is normal
+	} else if err != nil {
+		if explicit {
+			fatal("Failed to load offsets database", "path", path, "error", err)
+		}
+		slog.Warn("Failed to load offsets database", "path", path, "error", err)
+	} else {
+		useOffsetsDB(db)
+		slog.Info("Loaded offsets database", "path", path, "version", db.Version, "entries", len(db.Offsets))
+	}
+	if cfg.URL != "" {
+		loadOffsetsCache()
+	}
+}
+
+// loadOffsetsCache loads the database cached by updateOffsetsDB if it's newer than the one in use.
+// A cache whose signature doesn't match (e.g. because the process stopped while it was being written)
+// is treated as if there was no cache.
+func loadOffsetsCache() {
+	path, err := getOffsetsCachePath()
+	if err != nil {
+		slog.Warn("Failed to get config dir to look for cached offsets database", "error", err)
+		return
+	}
+	db, err := nac.ReadOffsetsDB(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	} else if errors.Is(err, nac.ErrInvalidOffsetsSignature) {
+		slog.Info("Ignoring cached offsets database with mismatched signature", "path", path)
+		return
+	} else if err != nil {
+		slog.Warn("Failed to load cached offsets database", "path", path, "error", err)
+		return
+	}
+	if useOffsetsDB(db) {
+		slog.Info("Loaded cached offsets database", "path", path, "version", db.Version, "entries", len(db.Offsets))
+	}
+}
+
+// useOffsetsDB merges the database over the built-in offsets, unless a newer one is already in use.
+func useOffsetsDB(db *nac.OffsetsDB) bool {
+	if int64(db.Version) <= offsetsDBVersion.Load() {
+		return false
+	}
+	nac.UseOffsetsDB(db)
+	offsetsDBVersion.Store(int64(db.Version))
+	return true
+}
+
+// offsetsSignatureURL returns the URL of the signature for the database at rawURL,
+// which is the same URL with ".sig" appended to the path (i.e. before any query string).
+func offsetsSignatureURL(rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	parsed.Path += ".sig"
+	if parsed.RawPath != "" {
+		parsed.RawPath += ".sig"
+	}
+	return parsed.String(), nil
+}
+
+func fetchOffsetsFile(ctx context.Context, fileURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	req.Header.Set("User-Agent", submitUserAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxOffsetsDBSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	} else if len(data) > maxOffsetsDBSize {
+		return nil, fmt.Errorf("response is larger than %d bytes", maxOffsetsDBSize)
+	}
+	return data, nil
+}
+
+// updateOffsetsDB downloads the offsets database and its signature (see offsetsSignatureURL),
+// and if it's valid and newer than the one in use, caches it and merges it over the built-in offsets.
+// It returns whether a new database was applied.
+func updateOffsetsDB(ctx context.Context, cfg OffsetsConfig) (bool, error) {
+	signatureURL, err := offsetsSignatureURL(cfg.URL)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse offsets database URL: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, offsetsFetchTimeout)
+	defer cancel()
+	data, err := fetchOffsetsFile(ctx, cfg.URL)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch offsets database: %w", err)
+	}
+	signature, err := fetchOffsetsFile(ctx, signatureURL)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch offsets database signature: %w", err)
+	}
+	db, err := nac.ParseOffsetsDB(data, signature)
+	if err != nil {
+		return false, err
+	} else if !useOffsetsDB(db) {
+		slog.Debug("Fetched offsets database isn't newer than the one in use", "version", db.Version)
+		return false, nil
+	}
+	slog.Info("Updated offsets database", "url", cfg.URL, "version", db.Version, "entries", len(db.Offsets))
+	path, err := getOffsetsCachePath()
+	if err == nil {
+		err = writeOffsetsDBCache(path, data, signature)
+	}
+	if err != nil {
+		slog.Warn("Failed to cache offsets database", "error", err)
+	}
+	return true, nil
+}
+
+// writeOffsetsDBCache atomically replaces the database file and then the signature file.
+// If the process stops in between, the new database is left with the old signature,
+// which loadOffsetsCache treats as if there was no cache.
+func writeOffsetsDBCache(path string, data, signature []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	for _, file := range []struct {
+		path string
+		data []byte
+	}{{path, data}, {path + ".sig", signature}} {
+		err = os.WriteFile(file.path+".tmp", file.data, 0600)
+		if err == nil {
+			err = os.Rename(file.path+".tmp", file.path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runOffsetsUpdater periodically checks the URL for a newer offsets database.
+// New databases only take effect the next time identityservicesd is loaded (i.e. after a restart),
+// but having them cached means that the provider keeps working after macOS updates even if the URL isn't reachable.
+func runOffsetsUpdater(ctx context.Context, cfg OffsetsConfig) {
+	for {
+		nextUpdate := cfg.UpdateInterval
+		if _, err := updateOffsetsDB(ctx, cfg); err != nil {
+			slog.Warn("Failed to update offsets database", "error", err, "retry_in", offsetsUpdateRetryTime)
+			nextUpdate = min(offsetsUpdateRetryTime, cfg.UpdateInterval)
+		}
+		select {
+		case <-time.After(nextUpdate):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/beeper/mac-registration-provider/nac"
+)
+
+func TestOffsetsSignatureURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://example.com/offsets.json", "https://example.com/offsets.json.sig"},
+		{"https://example.com/offsets.json?token=abc&v=1", "https://example.com/offsets.json.sig?token=abc&v=1"},
+		{"https://example.com/dl?file=offsets.json", "https://example.com/dl.sig?file=offsets.json"},
+		{"https://example.com/offsets%2Fv2.json#latest", "https://example.com/offsets%2Fv2.json.sig#latest"},
+	}
+	for _, test := range tests {
+		if got, err := offsetsSignatureURL(test.url); err != nil {
+			t.Errorf("%s: %v", test.url, err)
+		} else if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.url, got, test.want)
+		}
+	}
+}
+
+// testOffsetsDB returns a database with the given version, whose entry isn't for any real binary.
+func testOffsetsDB(version int) []byte {
+	return []byte(fmt.Sprintf(`{"version": %d, "offsets": {"%064x": {"comment": "test", "arm64": {
+		"reference_symbol": "IDSProtoKeyTransparencyTrustedServiceReadFrom", "reference_address": "0xbf408",
+		"nac_init_address": "0x4c1cac", "nac_key_establishment_address": "0x4af510", "nac_sign_address": "0x48971c"}}}}`,
+		version, version))
+}
+
+// useTestOffsetsKey sets a newly generated offsets database public key for the duration of the test
+// and returns a function that signs databases with it.
+func useTestOffsetsKey(t *testing.T) func(data []byte) []byte {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := nac.OffsetsPublicKey
+	nac.OffsetsPublicKey = base64.StdEncoding.EncodeToString(publicKey)
+	t.Cleanup(func() {
+		nac.OffsetsPublicKey = oldKey
+		offsetsDBVersion.Store(0)
+		loadedOffsetsDBVersion.Store(0)
+	})
+	return func(data []byte) []byte {
+		return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, data)))
+	}
+}
+
+func TestOffsetsUpdater(t *testing.T) {
+	sign := useTestOffsetsKey(t)
+	reload := func(cfg OffsetsConfig) int64 {
+		offsetsDBVersion.Store(0)
+		loadOffsetsDB(cfg)
+		return offsetsDBVersion.Load()
+	}
+
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	explicitPath := filepath.Join(t.TempDir(), "offsets.json")
+	explicitData := testOffsetsDB(1)
+	if err := writeOffsetsDBCache(explicitPath, explicitData, sign(explicitData)); err != nil {
+		t.Fatal(err)
+	}
+	update := testOffsetsDB(2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/offsets.json":
+			_, _ = w.Write(update)
+		case "/offsets.json.sig":
+			_, _ = w.Write(sign(update))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	cfg := OffsetsConfig{File: explicitPath, URL: ts.URL + "/offsets.json?token=secret"}
+
+	if version := reload(cfg); version != 1 {
+		t.Fatalf("loaded version %d, want 1", version)
+	}
+	loadedOffsetsDBVersion.Store(offsetsDBVersion.Load())
+	if updated, err := updateOffsetsDB(context.Background(), cfg); err != nil || !updated {
+		t.Fatalf("update failed: %v %v", updated, err)
+	}
+	// The update is only used after a restart, so it must not be reported yet
+	if version := currentVersionsResponse().OffsetsVersion; version != 1 {
+		t.Errorf("reported version %d after background update, want 1", version)
+	}
+	if data, err := os.ReadFile(explicitPath); err != nil || !bytes.Equal(data, explicitData) {
+		t.Errorf("update overwrote the offsets file: %v", err)
+	}
+
+	// The cache is used on the next start if it's newer than the offsets file
+	if version := reload(cfg); version != 2 {
+		t.Errorf("loaded version %d with cache, want 2", version)
+	}
+	// A cache that was only partially written is ignored
+	cachePath, err := getOffsetsCachePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(cachePath, testOffsetsDB(3), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if version := reload(cfg); version != 1 {
+		t.Errorf("loaded version %d with mismatched cache, want 1", version)
+	}
+}
+
+func TestLoadDeriveSignatures(t *testing.T) {
+	sign := useTestOffsetsKey(t)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	// Signatures are never removed once loaded, so this only works if no other test has loaded any
+	if nac.Signatures() == nil {
+		if _, err := loadDeriveSignatures("", ""); err == nil {
+			t.Error("no error without any signatures")
+		}
+	}
+
+	writeDB := func(path, nacInit string) {
+		t.Helper()
+		data := []byte(`{"version": 1, "offsets": {}, "signatures": {"arm64": {
+			"nac_init": "` + nacInit + `", "nac_key_establishment": "7f 23 03 d5", "nac_sign": "ff c3 03 d1"}}}`)
+		if err := writeOffsetsDBCache(path, data, sign(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The installed database is used by default...
+	path, err := getOffsetsDBPath(OffsetsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeDB(path, "ff 43 01 d1")
+	if sigs, err := loadDeriveSignatures("", ""); err != nil {
+		t.Fatal(err)
+	} else if got := sigs.ForArch("arm64").NACInit.String(); got != "ff 43 01 d1" {
+		t.Errorf("got NACInit signature %s from installed database", got)
+	}
+	// ...unless a database file is given...
+	dbPath := filepath.Join(t.TempDir(), "offsets.json")
+	writeDB(dbPath, "ff 83 02 d1")
+	if sigs, err := loadDeriveSignatures("", dbPath); err != nil {
+		t.Fatal(err)
+	} else if got := sigs.ForArch("arm64").NACInit.String(); got != "ff 83 02 d1" {
+		t.Errorf("got NACInit signature %s from -db", got)
+	}
+	// ...while a signatures file always takes precedence
+	sigsPath := filepath.Join(t.TempDir(), "signatures.json")
+	err = os.WriteFile(sigsPath, []byte(`{"x86": {"nac_init": "55 48", "nac_key_establishment": "55 49", "nac_sign": "55 4a"}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sigs, err := loadDeriveSignatures(sigsPath, ""); err != nil {
+		t.Fatal(err)
+	} else if sigs.ForArch("arm64") != nil || sigs.ForArch("x86").NACInit.String() != "55 48" {
+		t.Errorf("unexpected signatures %+v", sigs)
+	}
+}
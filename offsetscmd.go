@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/beeper/mac-registration-provider/nac"
+)
+
+// OffsetsLintReport is the output of `offsets lint -json`.
+type OffsetsLintReport struct {
+	// OK is false if any errors were found. Warnings don't affect it.
+	OK      bool            `json:"ok"`
+	Source  string          `json:"source"`
+	Entries int             `json:"entries"`
+	Issues  []nac.LintIssue `json:"issues"`
+}
+
+const offsetsUsage = `Usage:
+  mac-registration-provider offsets lint [-json] [-db path]
+  mac-registration-provider offsets derive [-json] [-signatures path] [-db path] [-version 14.7] <identityservicesd>
+  mac-registration-provider offsets signatures [-db path] <identityservicesd>...`
+
+func cmdOffsets(args []string) {
+	if len(args) == 0 {
+		_, _ = fmt.Fprintln(os.Stderr, offsetsUsage)
+		os.Exit(exitCodeInvalidConfig)
+	}
+	switch args[0] {
+	case "lint":
+		cmdOffsetsLint(args[1:])
+	case "derive":
+		cmdOffsetsDerive(args[1:])
+	case "signatures":
+		cmdOffsetsSignatures(args[1:])
+	default:
+		_, _ = fmt.Fprintln(os.Stderr, offsetsUsage)
+		os.Exit(exitCodeInvalidConfig)
+	}
+}
+
+func cmdOffsetsLint(args []string) {
+	flags := flag.NewFlagSet("offsets lint", flag.ExitOnError)
+	jsonReport := flags.Bool("json", false, "Output the report as JSON")
+	dbPath := flags.String("db", "", "Lint an offsets database file instead of the built-in offsets. The signature isn't checked.")
+	_ = flags.Parse(args)
+
+	report := OffsetsLintReport{Source: "builtin"}
+	var entries []nac.LintEntry
+	if *dbPath != "" {
+		data, err := os.ReadFile(*dbPath)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitCodeInvalidConfig)
+		}
+		entries, err = nac.LintEntriesFromJSON(data)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "Failed to parse offsets database:", err)
+			os.Exit(exitCodeInvalidConfig)
+		}
+		report.Source = *dbPath
+	} else {
+		entries = nac.BuiltinLintEntries()
+	}
+	report.Entries = len(entries)
+	report.Issues = nac.LintOffsets(entries)
+	if report.Issues == nil {
+		report.Issues = []nac.LintIssue{}
+	}
+	report.OK = true
+	errorCount := 0
+	for _, issue := range report.Issues {
+		if issue.Severity == nac.LintError {
+			report.OK = false
+			errorCount++
+		}
+	}
+
+	if *jsonReport {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(&report)
+	} else {
+		for _, issue := range report.Issues {
+			fmt.Println(issue)
+		}
+		fmt.Printf("Checked %d entries from %s: %d error(s), %d warning(s)\n",
+			report.Entries, report.Source, errorCount, len(report.Issues)-errorCount)
+	}
+	if !report.OK {
+		os.Exit(exitCodeFatal)
+	}
+}
+
+// readUnverifiedOffsetsDB parses an offsets database without checking the signature or validating the offsets,
+// so that all problems can be reported by the linter instead of only the first one.
+func readUnverifiedOffsetsDB(path string) (*nac.OffsetsDB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var db nac.OffsetsDB
+	err = json.Unmarshal(data, &db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse offsets database: %w", err)
+	}
+	return &db, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/beeper/mac-registration-provider/machoscan"
+	"github.com/beeper/mac-registration-provider/nac"
+)
+
+// OffsetsDeriveResult is the output of `offsets derive -json`.
+type OffsetsDeriveResult struct {
+	Hash string `json:"hash"`
+	// Known is true if the binary already has offsets, in which case derived offsets should match them.
+	Known bool               `json:"known"`
+	Entry nac.OffsetsDBEntry `json:"entry"`
+	// Errors contains the reason offsets couldn't be derived for each failed arch.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// readMachOImages reads an identityservicesd binary and returns its hex-encoded SHA-256 hash and images.
+func readMachOImages(path string) (string, []*machoscan.Image, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	hash := sha256.Sum256(data)
+	images, err := machoscan.ReadImages(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return hex.EncodeToString(hash[:]), images, nil
+}
+
+func readSignaturesFile(path string) (*machoscan.Signatures, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sigs machoscan.Signatures
+	err = json.Unmarshal(data, &sigs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signatures: %w", err)
+	}
+	return &sigs, nil
+}
+
+// loadDeriveSignatures returns the signatures to derive offsets with: the signatures file if one is given,
+// or else the signatures from the given (unverified) offsets database, or from the installed database
+// (see loadOffsetsDB) and its cached updates, or the built-in signatures if the database has none.
+// The database is also merged over the built-in offsets, so that binaries it has offsets for are reported as known.
+func loadDeriveSignatures(signaturesPath, dbPath string) (*machoscan.Signatures, error) {
+	if dbPath != "" {
+		db, err := readUnverifiedOffsetsDB(dbPath)
+		if err != nil {
+			return nil, err
+		}
+		nac.UseOffsetsDB(db)
+	} else {
+		loadOffsetsDB(OffsetsConfig{})
+		loadOffsetsCache()
+	}
+	if signaturesPath != "" {
+		return readSignaturesFile(signaturesPath)
+	} else if sigs := nac.Signatures(); sigs != nil {
+		return sigs, nil
+	}
+	return nil, errors.New("neither the offsets database nor the built-in signatures contain signatures, pass a signatures file with -signatures or a database with -db")
+}
+
+func cmdOffsetsDerive(args []string) {
+	flags := flag.NewFlagSet("offsets derive", flag.ExitOnError)
+	jsonOutput := flags.Bool("json", false, "Output the result as JSON")
+	signaturesPath := flags.String("signatures", "", "JSON file with NAC function signatures, as output by `offsets signatures` (defaults to the signatures in the offsets database, or the built-in ones)")
+	dbPath := flags.String("db", "", "Offsets database to use instead of the installed one. The signature isn't checked.")
+	version := flags.String("version", "", "macOS version the binary is from, used to name the offsets")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		_, _ = fmt.Fprintln(os.Stderr, offsetsUsage)
+		os.Exit(exitCodeInvalidConfig)
+	}
+	sigs, err := loadDeriveSignatures(*signaturesPath, *dbPath)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCodeInvalidConfig)
+	}
+	hash, images, err := readMachOImages(flags.Arg(0))
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCodeFatal)
+	}
+
+	result := OffsetsDeriveResult{Hash: hash, Errors: make(map[string]string)}
+	if *version != "" {
+		result.Entry.Comment = "macOS " + *version
+	}
+	for _, img := range images {
+		if _, ok := nac.KnownOffsets(hash, img.Arch); ok {
+			result.Known = true
+		}
+		var offs *machoscan.Offsets
+		offs, err = img.FindOffsets(sigs.ForArch(img.Arch))
+		if errors.Is(err, machoscan.ErrNoSignatures) {
+			// Still report the reference symbol, which doesn't need signatures
+			if name, addr, refErr := img.FindReferenceSymbol(nil); refErr == nil {
+				err = fmt.Errorf("%w (reference symbol %s is at 0x%x)", err, name, addr)
+			}
+		}
+		if err != nil {
+			result.Errors[img.Arch] = err.Error()
+			continue
+		}
+		imdOffs := nac.IMDOffsets(*offs)
+		if img.Arch == "arm64" {
+			result.Entry.ARM64 = &imdOffs
+		} else {
+			result.Entry.X86 = &imdOffs
+		}
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(&result)
+	} else {
+		printDerivedOffsets(&result, *version)
+	}
+	if len(result.Errors) > 0 {
+		os.Exit(exitCodeFatal)
+	}
+}
+
+// printDerivedOffsets prints the derived offsets in the same format as the built-in offsets table.
+func printDerivedOffsets(result *OffsetsDeriveResult, version string) {
+	fmt.Println("SHA-256:", result.Hash)
+	if result.Known {
+		fmt.Println("The binary already has known offsets")
+	}
+	for _, arch := range []string{"x86", "arm64"} {
+		if err, ok := result.Errors[arch]; ok {
+			fmt.Printf("Failed to derive %s offsets: %s\n", arch, err)
+		}
+	}
+	if result.Entry.X86 == nil && result.Entry.ARM64 == nil {
+		return
+	}
+	if version == "" {
+		version = "unknown"
+	}
+	varName := "offsets_" + strings.NewReplacer(".", "_", " ", "_").Replace(version)
+	fmt.Println()
+	fmt.Printf("var %s = imdOffsetTuple{\n", varName)
+	for _, arch := range []struct {
+		name string
+		offs *nac.IMDOffsets
+	}{{"x86", result.Entry.X86}, {"arm64", result.Entry.ARM64}} {
+		if arch.offs == nil {
+			continue
+		}
+		fmt.Printf("\t%s: IMDOffsets{\n", arch.name)
+		fmt.Printf("\t\tReferenceSymbol:            %q,\n", arch.offs.ReferenceSymbol)
+		fmt.Printf("\t\tReferenceAddress:           0x%06x,\n", arch.offs.ReferenceAddress)
+		fmt.Printf("\t\tNACInitAddress:             0x%06x,\n", arch.offs.NACInitAddress)
+		fmt.Printf("\t\tNACKeyEstablishmentAddress: 0x%06x,\n", arch.offs.NACKeyEstablishmentAddress)
+		fmt.Printf("\t\tNACSignAddress:             0x%06x,\n", arch.offs.NACSignAddress)
+		fmt.Println("\t},")
+	}
+	fmt.Println("}")
+	fmt.Println()
+	fmt.Printf("\t{%q, %q, %s},\n", result.Hash, "macOS "+version, varName)
+}
+
+func cmdOffsetsSignatures(args []string) {
+	flags := flag.NewFlagSet("offsets signatures", flag.ExitOnError)
+	dbPath := flags.String("db", "", "Offsets database to use in addition to the built-in offsets. The signature isn't checked.")
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		_, _ = fmt.Fprintln(os.Stderr, offsetsUsage)
+		os.Exit(exitCodeInvalidConfig)
+	}
+	if *dbPath != "" {
+		db, err := readUnverifiedOffsetsDB(*dbPath)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitCodeInvalidConfig)
+		}
+		nac.UseOffsetsDB(db)
+	}
+
+	imagesByArch := make(map[string][]*machoscan.Image)
+	offsetsByArch := make(map[string][]*machoscan.Offsets)
+	for _, path := range flags.Args() {
+		hash, images, err := readMachOImages(path)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitCodeFatal)
+		}
+		for _, img := range images {
+			known, ok := nac.KnownOffsets(hash, img.Arch)
+			if !ok {
+				_, _ = fmt.Fprintf(os.Stderr, "Skipping %s of %s: no known offsets for %s\n", img.Arch, path, hash)
+				continue
+			} else if refAddr, found := img.SymbolOffset(known.ReferenceSymbol); !found || refAddr != known.ReferenceAddress {
+				_, _ = fmt.Fprintf(os.Stderr, "Skipping %s of %s: reference symbol %s isn't at 0x%x\n", img.Arch, path, known.ReferenceSymbol, known.ReferenceAddress)
+				continue
+			}
+			offs := machoscan.Offsets(known)
+			imagesByArch[img.Arch] = append(imagesByArch[img.Arch], img)
+			offsetsByArch[img.Arch] = append(offsetsByArch[img.Arch], &offs)
+		}
+	}
+
+	var sigs machoscan.Signatures
+	for arch, images := range imagesByArch {
+		archSigs, err := machoscan.LearnSignatures(images, offsetsByArch[arch])
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Failed to learn %s signatures: %v\n", arch, err)
+			os.Exit(exitCodeFatal)
+		}
+		if arch == "arm64" {
+			sigs.ARM64 = archSigs
+		} else {
+			sigs.X86 = archSigs
+		}
+	}
+	if sigs.X86 == nil && sigs.ARM64 == nil {
+		_, _ = fmt.Fprintln(os.Stderr, "None of the binaries have known offsets")
+		os.Exit(exitCodeFatal)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(&sigs)
+}
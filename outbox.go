@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// submitOutbox persists the latest undelivered payload for each submit target,
+// so that it can be redelivered if the process is restarted before delivery succeeds.
+// A nil outbox is valid and doesn't store anything.
+type submitOutbox struct {
+	path    string
+	lock    sync.Mutex
+	pending map[string]*ReqSubmitValidationData
+}
+
+func loadSubmitOutbox(path string) (*submitOutbox, error) {
+	if path == "" {
+		return nil, nil
+	}
+	outbox := &submitOutbox{path: path, pending: make(map[string]*ReqSubmitValidationData)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return outbox, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+	err = json.Unmarshal(data, &outbox.pending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse outbox: %w", err)
+	}
+	return outbox, nil
+}
+
+// saveLocked writes the outbox to disk. The caller must hold the lock.
+func (outbox *submitOutbox) saveLocked() {
+	err := os.MkdirAll(filepath.Dir(outbox.path), 0700)
+	if err == nil {
+		var data []byte
+		data, err = json.Marshal(outbox.pending)
+		if err == nil {
+			err = os.WriteFile(outbox.path, data, 0600)
+		}
+	}
+	if err != nil {
+		slog.Warn("Failed to save submit outbox", "error", err)
+	}
+}
+
+// Get returns the pending payload for the given target URL if it hasn't expired yet.
+func (outbox *submitOutbox) Get(url string) *ReqSubmitValidationData {
+	if outbox == nil {
+		return nil
+	}
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+	payload := outbox.pending[url]
+	if payload == nil || time.Now().After(payload.ValidUntil) {
+		return nil
+	}
+	return payload
+}
+
+// Put marks the payload as pending for the given target, unless a fresher payload is already pending.
+func (outbox *submitOutbox) Put(url string, payload *ReqSubmitValidationData) {
+	if outbox == nil {
+		return
+	}
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+	if existing := outbox.pending[url]; existing != nil && existing.ValidUntil.After(payload.ValidUntil) {
+		return
+	}
+	outbox.pending[url] = payload
+	outbox.saveLocked()
+}
+
+// Remove removes the payload from the outbox if it's still the pending payload for the given target.
+func (outbox *submitOutbox) Remove(url string, payload *ReqSubmitValidationData) {
+	if outbox == nil {
+		return
+	}
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+	if existing := outbox.pending[url]; existing != nil && existing.ValidUntil.Equal(payload.ValidUntil) {
+		delete(outbox.pending, url)
+		outbox.saveLocked()
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"slices"
+)
+
+// ProtocolVersion is the version of the relay protocol implemented by this provider.
+// Version 1 is the original protocol without version or capability negotiation.
+const ProtocolVersion = 2
+
+const legacyProtocolVersion = 1
+
+const (
+	CapabilityPing           = "ping"
+	CapabilityVersionInfo    = "get-version-info"
+	CapabilityValidationData = "get-validation-data"
+	CapabilitySubscribe      = "subscribe-validation-data"
+)
+
+// providerCapabilities are the capabilities advertised by this provider in the register request.
+var providerCapabilities = []string{CapabilityPing, CapabilityVersionInfo, CapabilityValidationData, CapabilitySubscribe}
+
+// legacyCapabilities are the capabilities assumed for relays that don't advertise any.
+var legacyCapabilities = []string{CapabilityPing, CapabilityVersionInfo, CapabilityValidationData}
+
+// CapabilitySet is the set of capabilities negotiated for a connection.
+type CapabilitySet map[string]struct{}
+
+func NewCapabilitySet(caps ...string) CapabilitySet {
+	set := make(CapabilitySet, len(caps))
+	for _, capability := range caps {
+		set[capability] = struct{}{}
+	}
+	return set
+}
+
+func (cs CapabilitySet) Has(capability string) bool {
+	_, ok := cs[capability]
+	return ok
+}
+
+func (cs CapabilitySet) List() []string {
+	list := make([]string, 0, len(cs))
+	for capability := range cs {
+		list = append(list, capability)
+	}
+	slices.Sort(list)
+	return list
+}
+
+// negotiateProtocol determines the protocol version and capabilities to use for a relay connection
+// based on the relay's register response. Relays that don't advertise a protocol version are
+// assumed to speak the legacy protocol with the legacy capabilities.
+func negotiateProtocol(resp *RegisterBody) (int, CapabilitySet) {
+	if resp.ProtocolVersion == 0 {
+		return legacyProtocolVersion, NewCapabilitySet(legacyCapabilities...)
+	}
+	serverCaps := NewCapabilitySet(resp.Capabilities...)
+	negotiated := make(CapabilitySet)
+	for _, capability := range providerCapabilities {
+		if serverCaps.Has(capability) {
+			negotiated[capability] = struct{}{}
+		}
+	}
+	return min(resp.ProtocolVersion, ProtocolVersion), negotiated
+}
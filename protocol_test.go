@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestNegotiateProtocol(t *testing.T) {
+	tests := []struct {
+		name        string
+		resp        RegisterBody
+		wantVersion int
+		wantCaps    []string
+	}{{
+		name:        "legacy relay",
+		resp:        RegisterBody{},
+		wantVersion: legacyProtocolVersion,
+		wantCaps:    []string{CapabilityValidationData, CapabilityVersionInfo, CapabilityPing},
+	}, {
+		name:        "legacy relay ignores capabilities",
+		resp:        RegisterBody{Capabilities: []string{CapabilitySubscribe}},
+		wantVersion: legacyProtocolVersion,
+		wantCaps:    []string{CapabilityValidationData, CapabilityVersionInfo, CapabilityPing},
+	}, {
+		name:        "same version",
+		resp:        RegisterBody{ProtocolVersion: ProtocolVersion, Capabilities: providerCapabilities},
+		wantVersion: ProtocolVersion,
+		wantCaps:    providerCapabilities,
+	}, {
+		name:        "newer relay",
+		resp:        RegisterBody{ProtocolVersion: ProtocolVersion + 1, Capabilities: append([]string{"teleport"}, providerCapabilities...)},
+		wantVersion: ProtocolVersion,
+		wantCaps:    providerCapabilities,
+	}, {
+		name:        "subset of capabilities",
+		resp:        RegisterBody{ProtocolVersion: ProtocolVersion, Capabilities: []string{CapabilityValidationData, "teleport"}},
+		wantVersion: ProtocolVersion,
+		wantCaps:    []string{CapabilityValidationData},
+	}, {
+		name:        "no capabilities",
+		resp:        RegisterBody{ProtocolVersion: ProtocolVersion},
+		wantVersion: ProtocolVersion,
+		wantCaps:    []string{},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version, caps := negotiateProtocol(&test.resp)
+			if version != test.wantVersion {
+				t.Errorf("got version %d, want %d", version, test.wantVersion)
+			}
+			wantCaps := slices.Clone(test.wantCaps)
+			slices.Sort(wantCaps)
+			if !slices.Equal(caps.List(), wantCaps) {
+				t.Errorf("got capabilities %v, want %v", caps.List(), wantCaps)
+			}
+		})
+	}
+}
+
+func TestHandleCommandCapabilities(t *testing.T) {
+	resetCache(t)
+	handler := &commandHandler{gen: &FakeGenerator{}, caps: NewCapabilitySet(CapabilityVersionInfo)}
+	ctx := context.Background()
+	tests := []struct {
+		command  string
+		wantErr  bool
+		wantResp bool
+	}{
+		{"get-version-info", false, true},
+		{"get-validation-data", true, false},
+		{"subscribe-validation-data", true, false},
+		{"ping", true, false},
+		// Pongs must never be answered, not even with an error
+		{"pong", false, false},
+		{"teleport", true, false},
+	}
+	for _, test := range tests {
+		resp, err := handler.handleCommand(ctx, WebsocketRequest[json.RawMessage]{Command: test.command, ReqID: 2})
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", test.command, err, test.wantErr)
+		}
+		if (resp != nil) != test.wantResp {
+			t.Errorf("%s: got response %v, want response: %v", test.command, resp, test.wantResp)
+		}
+	}
+}
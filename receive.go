@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// receivedDataStore keeps the freshest unexpired validation data submitted by each device.
+type receivedDataStore struct {
+	path string
+	lock sync.RWMutex
+	data map[string]*ReqSubmitValidationData
+}
+
+func deviceKey(data *ReqSubmitValidationData) string {
+	return data.DeviceInfo.SerialNumber + "/" + data.DeviceInfo.UniqueDeviceID
+}
+
+func loadReceivedDataStore(path string) (*receivedDataStore, error) {
+	store := &receivedDataStore{path: path, data: make(map[string]*ReqSubmitValidationData)}
+	if path == "" {
+		return store, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read store: %w", err)
+	}
+	var items []*ReqSubmitValidationData
+	err = json.Unmarshal(data, &items)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse store: %w", err)
+	}
+	for _, item := range items {
+		store.data[deviceKey(item)] = item
+	}
+	return store, nil
+}
+
+// saveLocked writes the store to disk. The caller must hold the lock.
+func (store *receivedDataStore) saveLocked() error {
+	if store.path == "" {
+		return nil
+	}
+	items := make([]*ReqSubmitValidationData, 0, len(store.data))
+	for _, item := range store.data {
+		items = append(items, item)
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		return fmt.Errorf("failed to encode store: %w", err)
+	}
+	err = os.WriteFile(store.path, data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	return nil
+}
+
+// Put stores the given data if it's fresher than the currently stored data for the same device.
+func (store *receivedDataStore) Put(item *ReqSubmitValidationData) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	key := deviceKey(item)
+	existing, ok := store.data[key]
+	if ok && !item.ValidUntil.After(existing.ValidUntil) {
+		return false, nil
+	}
+	store.data[key] = item
+	return true, store.saveLocked()
+}
+
+// Get returns the freshest unexpired data of the device with the given serial number or unique device ID.
+// If device is empty, the freshest data of any device is returned.
+func (store *receivedDataStore) Get(device string) *ReqSubmitValidationData {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	var best *ReqSubmitValidationData
+	for _, item := range store.data {
+		if device != "" && item.DeviceInfo.SerialNumber != device && item.DeviceInfo.UniqueDeviceID != device {
+			continue
+		} else if best == nil || item.ValidUntil.After(best.ValidUntil) {
+			best = item
+		}
+	}
+	if best == nil || time.Now().After(best.ValidUntil) {
+		return nil
+	}
+	return best
+}
+
+func checkBearerToken(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	reqToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(reqToken), []byte(token)) == 1
+}
+
+func writeJSONResponse(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+type receiveServer struct {
+	store     *receivedDataStore
+	token     string
+	readToken string
+}
+
+func (rs *receiveServer) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	if !checkBearerToken(r, rs.token) {
+		writeJSONResponse(w, http.StatusUnauthorized, ErrorResponse{Error: "invalid token"})
+		return
+	}
+	var req ReqSubmitValidationData
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024)).Decode(&req)
+	if err != nil {
+		writeJSONResponse(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("failed to parse request: %v", err)})
+		return
+	} else if len(req.ValidationData) == 0 {
+		writeJSONResponse(w, http.StatusBadRequest, ErrorResponse{Error: "missing validation data"})
+		return
+	} else if req.DeviceInfo.SerialNumber == "" && req.DeviceInfo.UniqueDeviceID == "" {
+		writeJSONResponse(w, http.StatusBadRequest, ErrorResponse{Error: "missing device identifier"})
+		return
+	} else if !req.ValidUntil.After(time.Now()) {
+		writeJSONResponse(w, http.StatusBadRequest, ErrorResponse{Error: "validation data has already expired"})
+		return
+	}
+	stored, err := rs.store.Put(&req)
+	if err != nil {
+		slog.Error("Failed to save validation data", "device", deviceKey(&req), "error", err)
+		writeJSONResponse(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to save validation data"})
+		return
+	} else if stored {
+		slog.Info("Received validation data", "device", deviceKey(&req), "valid_until", req.ValidUntil)
+	} else {
+		slog.Info("Ignored validation data older than the stored data", "device", deviceKey(&req))
+	}
+	writeJSONResponse(w, http.StatusOK, EmptyResponse{})
+}
+
+func (rs *receiveServer) handleGet(w http.ResponseWriter, r *http.Request) {
+	if !checkBearerToken(r, rs.readToken) {
+		writeJSONResponse(w, http.StatusUnauthorized, ErrorResponse{Error: "invalid token"})
+		return
+	}
+	device := strings.Trim(strings.TrimPrefix(r.URL.Path, "/validation-data"), "/")
+	data := rs.store.Get(device)
+	if data == nil {
+		writeJSONResponse(w, http.StatusNotFound, ErrorResponse{Error: "no unexpired validation data found"})
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, data)
+}
+
+func (rs *receiveServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/validation-data":
+		rs.handleSubmit(w, r)
+	case r.Method == http.MethodGet && (r.URL.Path == "/validation-data" || strings.HasPrefix(r.URL.Path, "/validation-data/")):
+		rs.handleGet(w, r)
+	default:
+		writeJSONResponse(w, http.StatusNotFound, ErrorResponse{Error: "not found"})
+	}
+}
+
+func cmdReceive(args []string) {
+	flags := flag.NewFlagSet("receive", flag.ExitOnError)
+	listen := flags.String("listen", ":8080", "Address to listen on")
+	token := flags.String("token", "", "Bearer token that submitters must provide")
+	readToken := flags.String("read-token", "", "Bearer token required to fetch stored data (defaults to -token)")
+	storePath := flags.String("store", "", "File to save received validation data in (defaults to memory only)")
+	_ = flags.Parse(args)
+	if *readToken == "" {
+		*readToken = *token
+	}
+	if *token == "" {
+		slog.Warn("No -token specified, anyone can submit validation data")
+	}
+
+	store, err := loadReceivedDataStore(*storePath)
+	if err != nil {
+		fatal("Failed to load store", "error", err)
+	}
+	slog.Info("Receiving validation data", "url", fmt.Sprintf("http://%s/validation-data", *listen))
+	err = http.ListenAndServe(*listen, &receiveServer{store: store, token: *token, readToken: *readToken})
+	if err != nil {
+		fatal("Failed to listen", "error", err)
+	}
+}
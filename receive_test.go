@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/beeper/mac-registration-provider/versions"
+)
+
+func testSubmitPayload(serial string, data string, validUntil time.Time) *ReqSubmitValidationData {
+	return &ReqSubmitValidationData{
+		ValidationData: []byte(data),
+		ValidUntil:     validUntil,
+		DeviceInfo:     versions.Versions{SerialNumber: serial, UniqueDeviceID: "udid-" + serial},
+	}
+}
+
+func doReceiveRequest(t *testing.T, handler http.Handler, method, path, token string, payload *ReqSubmitValidationData) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	if payload != nil {
+		if err := json.NewEncoder(&body).Encode(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &body)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestReceiveSubmitValidation(t *testing.T) {
+	store, err := loadReceivedDataStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := &receiveServer{store: store, token: "submit", readToken: "read"}
+	future := time.Now().Add(10 * time.Minute)
+	tests := []struct {
+		name    string
+		token   string
+		payload *ReqSubmitValidationData
+		want    int
+	}{
+		{"missing token", "", testSubmitPayload("A", "data", future), http.StatusUnauthorized},
+		{"wrong token", "read", testSubmitPayload("A", "data", future), http.StatusUnauthorized},
+		{"no data", "submit", testSubmitPayload("A", "", future), http.StatusBadRequest},
+		{"no device", "submit", &ReqSubmitValidationData{ValidationData: []byte("data"), ValidUntil: future}, http.StatusBadRequest},
+		{"expired", "submit", testSubmitPayload("A", "data", time.Now().Add(-time.Second)), http.StatusBadRequest},
+		{"valid", "submit", testSubmitPayload("A", "data", future), http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := doReceiveRequest(t, rs, http.MethodPost, "/validation-data", test.token, test.payload)
+			if rec.Code != test.want {
+				t.Errorf("got status %d, want %d: %s", rec.Code, test.want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestReceiveKeepsFreshestData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "received.json")
+	store, err := loadReceivedDataStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := &receiveServer{store: store}
+	now := time.Now().Truncate(time.Second)
+	submit := func(payload *ReqSubmitValidationData) {
+		t.Helper()
+		if rec := doReceiveRequest(t, rs, http.MethodPost, "/validation-data", "", payload); rec.Code != http.StatusOK {
+			t.Fatalf("submit returned status %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+	get := func(path string) *ReqSubmitValidationData {
+		t.Helper()
+		rec := doReceiveRequest(t, rs, http.MethodGet, path, "", nil)
+		if rec.Code == http.StatusNotFound {
+			return nil
+		} else if rec.Code != http.StatusOK {
+			t.Fatalf("get %s returned status %d", path, rec.Code)
+		}
+		var data ReqSubmitValidationData
+		if err := json.NewDecoder(rec.Body).Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		return &data
+	}
+
+	submit(testSubmitPayload("A", "a-fresh", now.Add(10*time.Minute)))
+	// Stale data for the same device is accepted but doesn't replace the stored data
+	submit(testSubmitPayload("A", "a-stale", now.Add(5*time.Minute)))
+	submit(testSubmitPayload("B", "b", now.Add(12*time.Minute)))
+
+	if data := get("/validation-data/A"); data == nil || string(data.ValidationData) != "a-fresh" {
+		t.Errorf("unexpected data for A by serial: %+v", data)
+	}
+	if data := get("/validation-data/udid-A"); data == nil || string(data.ValidationData) != "a-fresh" {
+		t.Errorf("unexpected data for A by unique device ID: %+v", data)
+	}
+	if data := get("/validation-data"); data == nil || string(data.ValidationData) != "b" {
+		t.Errorf("unexpected freshest data: %+v", data)
+	}
+	if data := get("/validation-data/C"); data != nil {
+		t.Errorf("unexpected data for unknown device: %+v", data)
+	}
+
+	// The store is persisted, and stale data must not have overwritten the fresh data on disk either
+	reloaded, err := loadReceivedDataStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := reloaded.Get("A"); data == nil || string(data.ValidationData) != "a-fresh" {
+		t.Errorf("unexpected data for A after reload: %+v", data)
+	}
+}
+
+func TestReceivedDataStoreSkipsExpired(t *testing.T) {
+	store, err := loadReceivedDataStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Data can expire after it was stored, in which case it must no longer be served
+	stored, err := store.Put(testSubmitPayload("A", "old", time.Now().Add(-time.Minute)))
+	if err != nil || !stored {
+		t.Fatalf("Put returned %v, %v", stored, err)
+	}
+	if data := store.Get("A"); data != nil {
+		t.Errorf("expired data was returned: %+v", data)
+	}
+}
+
+func TestReceiveReadToken(t *testing.T) {
+	store, err := loadReceivedDataStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := &receiveServer{store: store, token: "submit", readToken: "read"}
+	if rec := doReceiveRequest(t, rs, http.MethodPost, "/validation-data", "submit", testSubmitPayload("A", "data", time.Now().Add(time.Hour))); rec.Code != http.StatusOK {
+		t.Fatalf("submit returned status %d", rec.Code)
+	}
+	if rec := doReceiveRequest(t, rs, http.MethodGet, "/validation-data", "submit", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("get with submit token returned status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := doReceiveRequest(t, rs, http.MethodGet, "/validation-data", "read", nil); rec.Code != http.StatusOK {
+		t.Errorf("get with read token returned status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
-	"sync"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"nhooyr.io/websocket"
@@ -30,6 +33,9 @@ type RegisterBody struct {
 	Commit   string            `json:"commit,omitempty"`
 	Versions versions.Versions `json:"versions"`
 	Error    string            `json:"error,omitempty"`
+
+	ProtocolVersion int      `json:"protocol_version,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty"`
 }
 
 type ErrorResponse struct {
@@ -40,6 +46,15 @@ type EmptyResponse struct{}
 
 type VersionsResponse struct {
 	Versions versions.Versions `json:"versions"`
+	// OffsetsVersion is the version of the offsets database in use, or 0 if only built-in offsets are used.
+	OffsetsVersion int `json:"offsets_version,omitempty"`
+}
+
+func currentVersionsResponse() VersionsResponse {
+	return VersionsResponse{
+		Versions:       versions.Current,
+		OffsetsVersion: int(loadedOffsetsDBVersion.Load()),
+	}
 }
 
 type ValidationDataResponse struct {
@@ -47,41 +62,49 @@ type ValidationDataResponse struct {
 	ValidUntil time.Time `json:"valid_until"`
 }
 
-var dataCache ValidationDataResponse
-var cacheLock sync.Mutex
+// PushFunc sends an unsolicited message (i.e. one that isn't a response to a request) to the client.
+type PushFunc func(ctx context.Context, command string, data any) error
 
-func cachedGenerateData(ctx context.Context) (ValidationDataResponse, error) {
-	cacheLock.Lock()
-	defer cacheLock.Unlock()
-	if time.Now().UTC().Add(5 * time.Minute).After(dataCache.ValidUntil) {
-		data, validUntil, err := GenerateValidationData(ctx)
-		if err != nil {
-			return ValidationDataResponse{}, err
-		}
-		dataCache = ValidationDataResponse{Data: data, ValidUntil: validUntil}
-	}
-	return dataCache, nil
+// commandHandler handles commands from a single relay connection or local socket client.
+type commandHandler struct {
+	gen  Generator
+	caps CapabilitySet
+	push PushFunc
+
+	subscribed atomic.Bool
 }
 
-func handleCommand(ctx context.Context, req WebsocketRequest[json.RawMessage]) (any, error) {
+// handleCommand handles a command from the client.
+// Commands whose capability (which has the same name as the command) wasn't negotiated for the connection are rejected.
+// Pongs are responses to our own pings, so they're always ignored rather than answered with an error.
+func (ch *commandHandler) handleCommand(ctx context.Context, req WebsocketRequest[json.RawMessage]) (any, error) {
+	switch req.Command {
+	case "ping", "get-version-info", "get-validation-data", "subscribe-validation-data":
+		if !ch.caps.Has(req.Command) {
+			return nil, fmt.Errorf("command %q is not supported by the negotiated capabilities", req.Command)
+		}
+	}
 	switch req.Command {
 	case "pong":
 		return nil, nil
 	case "ping":
-		// Pre-cache validation data on ping
+		// Pre-cache validation data on ping. This shouldn't be canceled if the connection drops,
+		// as the data will still be useful after reconnecting.
 		go func() {
-			_, err := cachedGenerateData(ctx)
+			_, err := cachedGenerateData(context.WithoutCancel(ctx), ch.gen)
 			if err != nil {
-				log.Printf("Failed to pregenerate validation data on ping: %v", err)
+				slog.Warn("Failed to pregenerate validation data on ping", "error", err)
 			} else {
-				log.Println("Pregenerated validation data on ping")
+				slog.Debug("Pregenerated validation data on ping")
 			}
 		}()
 		return EmptyResponse{}, nil
 	case "get-version-info":
-		return VersionsResponse{Versions: versions.Current}, nil
+		return currentVersionsResponse(), nil
 	case "get-validation-data":
-		return cachedGenerateData(ctx)
+		return cachedGenerateData(ctx, ch.gen)
+	case "subscribe-validation-data":
+		return ch.subscribe(ctx)
 	default:
 		return nil, fmt.Errorf("unknown command %q", req.Command)
 	}
@@ -97,37 +120,67 @@ func isDir(dir string) bool {
 	return err == nil && stat.IsDir()
 }
 
-func readConfig() (string, *RelayConfig, error) {
-	var configPath string
+// getConfigDir returns the directory where config files are stored by default,
+// migrating the legacy config directory if necessary.
+func getConfigDir() (string, error) {
+	baseConfigDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user config dir: %w", err)
+	}
+	configDir := filepath.Join(baseConfigDir, "beeper-registration-provider")
+	legacyConfigDir := filepath.Join(baseConfigDir, "beeper-validation-provider")
+	if isDir(legacyConfigDir) && !isDir(configDir) {
+		err = os.Rename(legacyConfigDir, configDir)
+		if err != nil {
+			slog.Warn("Failed to rename legacy config dir", "error", err)
+		}
+	}
+	return configDir, nil
+}
+
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// getRelayConfigPath returns the path of the file where the registration code for the given relay is saved.
+// The primary (first) relay uses config.json (or -config-path) for backwards compatibility,
+// while other relays get their own files in the same directory.
+func getRelayConfigPath(addr string, primary bool) (string, error) {
+	var configDir string
 	if *overrideConfigPath != "" {
-		configPath = *overrideConfigPath
+		if primary {
+			return *overrideConfigPath, nil
+		}
+		configDir = filepath.Dir(*overrideConfigPath)
 	} else {
-		baseConfigDir, err := os.UserConfigDir()
+		var err error
+		configDir, err = getConfigDir()
 		if err != nil {
-			return "", nil, fmt.Errorf("failed to get user config dir: %w", err)
+			return "", err
 		}
-		configPath = filepath.Join(baseConfigDir, "beeper-registration-provider", "config.json")
-		configDir := filepath.Dir(configPath)
-		legacyConfigDir := filepath.Join(baseConfigDir, "beeper-validation-provider")
-		if isDir(legacyConfigDir) && !isDir(configDir) {
-			err = os.Rename(legacyConfigDir, configDir)
-			if err != nil {
-				log.Printf("Failed to rename legacy config dir: %v", err)
-			}
+		if primary {
+			return filepath.Join(configDir, "config.json"), nil
 		}
 	}
+	parsedAddr, err := url.Parse(addr)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse relay address: %w", err)
+	}
+	name := unsafePathChars.ReplaceAllString(strings.Trim(parsedAddr.Host+parsedAddr.Path, "/"), "_")
+	return filepath.Join(configDir, fmt.Sprintf("relay-%s.json", name)), nil
+}
+
+func readConfig(configPath string) (*RelayConfig, error) {
 	configData, err := os.ReadFile(configPath)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		return "", nil, fmt.Errorf("failed to read config file: %w", err)
+		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 	var config RelayConfig
 	if configData != nil {
 		err = json.Unmarshal(configData, &config)
 		if err != nil {
-			return "", nil, fmt.Errorf("failed to parse config file: %w", err)
+			return nil, fmt.Errorf("failed to parse config file: %w", err)
 		}
 	}
-	return configPath, &config, nil
+	return &config, nil
 }
 
 func writeConfig(cfg *RelayConfig, configPath string) error {
@@ -147,8 +200,17 @@ func writeConfig(cfg *RelayConfig, configPath string) error {
 	return nil
 }
 
-func ConnectRelay(ctx context.Context, addr string) error {
-	configPath, config, err := readConfig()
+const initialRelayReconnectDelay = 2 * time.Second
+
+func ConnectRelay(ctx context.Context, addr, configPath string, gen Generator) error {
+	ctx = withMetricsMode(ctx, "relay")
+	registered := false
+	defer func() {
+		if !registered {
+			metricRelayConnects.WithLabelValues(addr, "failure").Inc()
+		}
+	}()
+	config, err := readConfig(configPath)
 	if err != nil {
 		return err
 	}
@@ -159,7 +221,7 @@ func ConnectRelay(ctx context.Context, addr string) error {
 		},
 	})
 	if err != nil {
-		return err
+		return RelayDialError{Err: err}
 	}
 	defer c.CloseNow()
 
@@ -171,26 +233,29 @@ func ConnectRelay(ctx context.Context, addr string) error {
 			Secret:   config.Secret,
 			Commit:   Commit,
 			Versions: versions.Current,
+
+			ProtocolVersion: ProtocolVersion,
+			Capabilities:    providerCapabilities,
 		},
 	})
 	if err != nil {
-		return fmt.Errorf("failed to write register request: %w", err)
+		return RelayWriteError{Message: "register request", Err: err}
 	}
 
 	var registerResp WebsocketRequest[*RegisterBody]
 	err = wsjson.Read(ctx, c, &registerResp)
 	if err != nil {
-		return fmt.Errorf("failed to read register response: %w", err)
-	} else if registerResp.Command != "response" || registerResp.ReqID != 1 {
-		return fmt.Errorf("unexpected register response %+v", registerResp)
+		return newRelayReadError(err)
+	} else if registerResp.Command != "response" || registerResp.ReqID != 1 || registerResp.Data == nil {
+		return RelayProtocolError{Message: fmt.Sprintf("unexpected register response %+v", registerResp)}
 	} else if registerResp.Data.Error != "" {
 		_ = os.Rename(configPath, configPath+".bak")
-		return fmt.Errorf("failed to register: %s", registerResp.Data.Error)
+		return RegistrationRejectedError{Reason: registerResp.Data.Error}
 	}
 
 	if config.Code == "" || config.Code != registerResp.Data.Code {
 		if config.Code != "" {
-			log.Println("Registration token changed")
+			slog.Warn("Registration token changed", "relay", addr)
 		}
 		config.Code = registerResp.Data.Code
 		config.Secret = registerResp.Data.Secret
@@ -200,13 +265,18 @@ func ConnectRelay(ctx context.Context, addr string) error {
 		}
 	}
 
+	protocolVersion, caps := negotiateProtocol(registerResp.Data)
 	if *jsonOutput {
-		_ = json.NewEncoder(os.Stdout).Encode(map[string]any{
-			"code": registerResp.Data.Code,
-			"path": configPath,
+		emitEvent(EventRelayRegistered, RelayRegisteredEvent{
+			Relay:           addr,
+			Code:            registerResp.Data.Code,
+			ConfigPath:      configPath,
+			ProtocolVersion: protocolVersion,
+			Capabilities:    caps.List(),
 		})
 	} else {
 		fmt.Println()
+		fmt.Println("Registered with", addr)
 		fmt.Println(" ┏━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┓")
 		fmt.Println(" ┃ iMessage registration code:", registerResp.Data.Code, "┃")
 		fmt.Println(" ┗━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┛")
@@ -214,50 +284,173 @@ func ConnectRelay(ctx context.Context, addr string) error {
 		fmt.Println("Delete", configPath, "if you want to regenerate the token")
 	}
 
-	reqID := 1
-	cancelableCtx, cancel := context.WithCancel(ctx)
+	registered = true
+	slog.Info("Negotiated relay protocol", "relay", addr, "protocol_version", protocolVersion, "capabilities", caps.List())
+	metricRelayConnects.WithLabelValues(addr, "success").Inc()
+	metricRelayConnected.WithLabelValues(addr).Set(1)
+	defer metricRelayConnected.WithLabelValues(addr).Set(0)
+	health.relayConnected(addr)
+
+	// The connection isn't tied to ctx directly, so that a command being handled when ctx is canceled
+	// (i.e. the process is shutting down) can still finish and the connection can be closed cleanly.
+	connCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
 	defer cancel()
+	stopDrainTimeout := context.AfterFunc(ctx, func() {
+		time.AfterFunc(shutdownTimeout, cancel)
+	})
+	defer stopDrainTimeout()
+
+	// Only send keepalive pings if the relay knows how to respond to them
+	if caps.Has(CapabilityPing) {
+		go func() {
+			ticker := time.NewTicker(3 * time.Minute)
+			defer ticker.Stop()
+			// Request ID 1 was used by the register request
+			reqID := 1
+			for {
+				select {
+				case <-ticker.C:
+					reqID++
+					err := wsjson.Write(connCtx, c, WebsocketRequest[any]{
+						Command: "ping",
+						ReqID:   reqID,
+					})
+					if err != nil {
+						slog.Warn("Failed to send ping to relay", "relay", addr, "error", err)
+					}
+				case <-connCtx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	handler := &commandHandler{
+		gen:  gen,
+		caps: caps,
+		push: func(ctx context.Context, command string, data any) error {
+			return wsjson.Write(ctx, c, WebsocketRequest[any]{
+				Command: command,
+				Data:    data,
+			})
+		},
+	}
+
+	requests := make(chan WebsocketRequest[json.RawMessage])
+	readErr := make(chan error, 1)
 	go func() {
-		ticker := time.NewTicker(3 * time.Minute)
-		defer ticker.Stop()
 		for {
+			var req WebsocketRequest[json.RawMessage]
+			err := wsjson.Read(connCtx, c, &req)
+			if err != nil {
+				readErr <- err
+				return
+			}
 			select {
-			case <-ticker.C:
-				reqID++
-				err = wsjson.Write(ctx, c, WebsocketRequest[any]{
-					Command: "ping",
-					ReqID:   reqID,
-				})
-			case <-cancelableCtx.Done():
+			case requests <- req:
+			case <-connCtx.Done():
 				return
 			}
 		}
 	}()
 
-	log.Printf("Connection successful")
+	closeGracefully := func() error {
+		slog.Info("Closing relay connection", "relay", addr)
+		err := c.Close(websocket.StatusGoingAway, "provider shutting down")
+		if err != nil {
+			slog.Warn("Failed to close relay connection cleanly", "relay", addr, "error", err)
+		}
+		return nil
+	}
+
+	slog.Info("Connected to relay", "relay", addr)
 	for {
+		// Don't accept new commands after shutdown has started, even if some are already waiting
+		if ctx.Err() != nil {
+			return closeGracefully()
+		}
 		var req WebsocketRequest[json.RawMessage]
-		err = wsjson.Read(ctx, c, &req)
-		if err != nil {
-			return fmt.Errorf("failed to read request: %w", err)
+		select {
+		case req = <-requests:
+		case err = <-readErr:
+			return newRelayReadError(err)
+		case <-ctx.Done():
+			return closeGracefully()
 		}
-		log.Printf("Received command %s/%d", req.Command, req.ReqID)
-		resp, err := handleCommand(ctx, req)
+		slog.Debug("Received command", "relay", addr, "command", req.Command, "req_id", req.ReqID)
+		start := time.Now()
+		// Use the connection context so that subscriptions stop when the connection dies
+		resp, err := handler.handleCommand(connCtx, req)
+		metricRelayCommands.WithLabelValues(addr, req.Command, resultLabel(err)).Inc()
 		if err != nil {
-			log.Printf("Command %s/%d failed: %v", req.Command, req.ReqID, err)
+			slog.Error("Command failed", "relay", addr, "command", req.Command, "req_id", req.ReqID, "duration", time.Since(start), "error", err)
 			resp = ErrorResponse{Error: err.Error()}
 		} else if resp == nil {
 			continue
 		} else {
-			log.Printf("Command %s/%d succeeded", req.Command, req.ReqID)
+			slog.Info("Command succeeded", "relay", addr, "command", req.Command, "req_id", req.ReqID, "duration", time.Since(start))
 		}
-		err = wsjson.Write(ctx, c, WebsocketRequest[any]{
+		emitEvent(EventCommand, CommandEvent{
+			ResultEvent: resultEvent(err),
+			Source:      ModeRelay,
+			Relay:       addr,
+			Command:     req.Command,
+			ReqID:       req.ReqID,
+			Duration:    time.Since(start).Seconds(),
+		})
+		err = wsjson.Write(connCtx, c, WebsocketRequest[any]{
 			Command: "response",
 			ReqID:   req.ReqID,
 			Data:    resp,
 		})
 		if err != nil {
-			return fmt.Errorf("failed to write response to %d: %w", req.ReqID, err)
+			return RelayWriteError{Message: fmt.Sprintf("response to %d", req.ReqID), Err: err}
+		}
+	}
+}
+
+// RunRelay keeps a connection to the given relay server open, reconnecting with backoff when it fails.
+// It only returns if the connection ends cleanly, ctx is canceled or ConnectRelay returns
+// an error that reconnecting won't fix (see shouldReconnect).
+func RunRelay(ctx context.Context, addr, configPath string, gen Generator) error {
+	reconnectIn := initialRelayReconnectDelay
+	lastReconnect := time.Now()
+	for {
+		err := ConnectRelay(ctx, addr, configPath, gen)
+		health.relayDisconnected(addr, err)
+		if err == nil || ctx.Err() != nil {
+			emitEvent(EventRelayDisconnected, RelayDisconnectedEvent{Relay: addr})
+			return nil
+		} else if !shouldReconnect(err) {
+			slog.Error("Error in relay connection, not reconnecting", "relay", addr, "error", err)
+			emitEvent(EventRelayDisconnected, RelayDisconnectedEvent{Relay: addr, Error: err.Error()})
+			return err
+		}
+		var closedErr RelayClosedError
+		if errors.As(err, &closedErr) {
+			// The relay closing the connection cleanly (e.g. when restarting) isn't a sign of problems,
+			// so reconnect quickly instead of continuing to back off.
+			reconnectIn = initialRelayReconnectDelay
+		}
+		slog.Warn("Error in relay connection, reconnecting", "relay", addr, "error", err, "retry_in", reconnectIn)
+		emitEvent(EventRelayDisconnected, RelayDisconnectedEvent{
+			Relay:        addr,
+			Error:        err.Error(),
+			Reconnecting: true,
+			ReconnectIn:  reconnectIn.Seconds(),
+		})
+		metricRelayReconnects.WithLabelValues(addr).Inc()
+		select {
+		case <-time.After(reconnectIn):
+		case <-ctx.Done():
+			return nil
+		}
+		if time.Since(lastReconnect) < 5*time.Minute {
+			if reconnectIn < 1*time.Minute {
+				reconnectIn *= 2
+			}
+		} else {
+			reconnectIn = initialRelayReconnectDelay
 		}
 	}
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+
+	"github.com/beeper/mac-registration-provider/relayserver"
+)
+
+// shortLivedGenerator is a FakeGenerator whose data expires just after minServeValidity,
+// so that subscribed connections push new data within a few seconds.
+type shortLivedGenerator struct {
+	FakeGenerator
+}
+
+func (gen *shortLivedGenerator) GenerateValidationData(ctx context.Context) ([]byte, time.Time, error) {
+	data, _, err := gen.FakeGenerator.GenerateValidationData(ctx)
+	return data, time.Now().Add(minServeValidity + 2*time.Second), err
+}
+
+// resetCache clears the shared validation data cache so tests don't see each other's data.
+func resetCache(t *testing.T) {
+	t.Helper()
+	cacheLock.Lock()
+	dataPool = &validationPool{size: 1}
+	cacheLock.Unlock()
+}
+
+func bridgeRequest(t *testing.T, baseURL, command, code string, into any) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/api/v1/bridge/"+command, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+code)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && into != nil {
+		err = json.NewDecoder(resp.Body).Decode(into)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func waitForRelayCode(t *testing.T, configPath string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		cfg, err := readConfig(configPath)
+		if err == nil && cfg.Code != "" {
+			return cfg.Code
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("provider didn't register in time")
+	return ""
+}
+
+// waitForProvider waits until the relay has a provider connected with the given code.
+func waitForProvider(t *testing.T, baseURL, code string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for bridgeRequest(t, baseURL, "get-version-info", code, nil) != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("provider didn't connect in time")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestRelayRoundTrip(t *testing.T) {
+	resetCache(t)
+	srv, err := relayserver.New(relayserver.Config{RequestTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	connErr := make(chan error, 1)
+	go func() {
+		connErr <- ConnectRelay(ctx, ts.URL, configPath, &shortLivedGenerator{})
+	}()
+	defer func() {
+		cancel()
+		select {
+		case err := <-connErr:
+			if err != nil {
+				t.Errorf("ConnectRelay returned error after cancel: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("ConnectRelay didn't return after cancel")
+		}
+	}()
+
+	code := waitForRelayCode(t, configPath)
+	waitForProvider(t, ts.URL, code)
+
+	var versionInfo VersionsResponse
+	if status := bridgeRequest(t, ts.URL, "get-version-info", code, &versionInfo); status != http.StatusOK {
+		t.Fatalf("get-version-info returned status %d", status)
+	} else if versionInfo.Versions != currentVersionsResponse().Versions {
+		t.Errorf("unexpected versions %+v", versionInfo.Versions)
+	}
+
+	var first ValidationDataResponse
+	if status := bridgeRequest(t, ts.URL, "get-validation-data", code, &first); status != http.StatusOK {
+		t.Fatalf("get-validation-data returned status %d", status)
+	} else if len(first.Data) == 0 || !first.ValidUntil.After(time.Now()) {
+		t.Fatalf("unexpected validation data %+v", first)
+	}
+
+	// The relay subscribes on registration, so it should start serving pushed data without asking again
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var pushed ValidationDataResponse
+		if status := bridgeRequest(t, ts.URL, "get-validation-data", code, &pushed); status != http.StatusOK {
+			t.Fatalf("get-validation-data returned status %d", status)
+		} else if !bytes.Equal(pushed.Data, first.Data) {
+			if !pushed.ValidUntil.After(first.ValidUntil) {
+				t.Errorf("pushed data isn't fresher than the first data: %v <= %v", pushed.ValidUntil, first.ValidUntil)
+			}
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("relay didn't receive pushed validation data in time")
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func TestRelayReregistersWithSavedCode(t *testing.T) {
+	resetCache(t)
+	srv, err := relayserver.New(relayserver.Config{RequestTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	configPath := filepath.Join(t.TempDir(), "config.json")
+
+	var codes []string
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		connErr := make(chan error, 1)
+		go func() {
+			connErr <- ConnectRelay(ctx, ts.URL, configPath, &FakeGenerator{})
+		}()
+		codes = append(codes, waitForRelayCode(t, configPath))
+		waitForProvider(t, ts.URL, codes[i])
+		cancel()
+		if err = <-connErr; err != nil {
+			t.Fatalf("connection %d: %v", i+1, err)
+		}
+	}
+	if codes[0] != codes[1] {
+		t.Errorf("code changed after reconnecting: %s -> %s", codes[0], codes[1])
+	}
+}
+
+func TestRelayRegistrationRejected(t *testing.T) {
+	srv, err := relayserver.New(relayserver.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	dir := t.TempDir()
+
+	// Register once to claim a code, then try to use it with the wrong secret
+	firstPath := filepath.Join(dir, "first.json")
+	ctx, cancel := context.WithCancel(context.Background())
+	connErr := make(chan error, 1)
+	go func() {
+		connErr <- ConnectRelay(ctx, ts.URL, firstPath, &FakeGenerator{})
+	}()
+	code := waitForRelayCode(t, firstPath)
+	cancel()
+	<-connErr
+
+	secondPath := filepath.Join(dir, "second.json")
+	err = writeConfig(&RelayConfig{Code: code, Secret: "wrong"}, secondPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ConnectRelay(context.Background(), ts.URL, secondPath, &FakeGenerator{})
+	var rejectedErr RegistrationRejectedError
+	if !errors.As(err, &rejectedErr) {
+		t.Fatalf("expected registration to be rejected, got %v", err)
+	}
+	if _, err = os.Stat(secondPath + ".bak"); err != nil {
+		t.Errorf("rejected config wasn't backed up: %v", err)
+	}
+}
+
+func TestRelayErrorHandling(t *testing.T) {
+	tests := []struct {
+		err           error
+		wantReconnect bool
+		wantExitCode  int
+	}{
+		{RegistrationRejectedError{Reason: "invalid secret"}, false, exitCodeRegistrationRejected},
+		{fmt.Errorf("relay: %w", RegistrationRejectedError{Reason: "invalid secret"}), false, exitCodeRegistrationRejected},
+		{RelayProtocolError{Message: "unexpected register response"}, true, exitCodeFatal},
+		{RelayDialError{Err: errors.New("connection refused")}, true, exitCodeFatal},
+		{RelayClosedError{Status: websocket.StatusGoingAway}, true, exitCodeFatal},
+	}
+	for _, test := range tests {
+		if reconnect := shouldReconnect(test.err); reconnect != test.wantReconnect {
+			t.Errorf("shouldReconnect(%v) = %v, want %v", test.err, reconnect, test.wantReconnect)
+		}
+		if code := relayExitCode(test.err); code != test.wantExitCode {
+			t.Errorf("relayExitCode(%v) = %d, want %d", test.err, code, test.wantExitCode)
+		}
+	}
+}
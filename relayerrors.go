@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"nhooyr.io/websocket"
+)
+
+// RegistrationRejectedError is returned by ConnectRelay if the relay rejected the registration,
+// e.g. because the saved secret doesn't match the code. Reconnecting won't help.
+type RegistrationRejectedError struct {
+	Reason string
+}
+
+func (err RegistrationRejectedError) Error() string {
+	return fmt.Sprintf("failed to register: %s", err.Reason)
+}
+
+// RelayDialError is returned by ConnectRelay if connecting to the relay failed.
+type RelayDialError struct {
+	Err error
+}
+
+func (err RelayDialError) Error() string {
+	return fmt.Sprintf("failed to connect: %v", err.Err)
+}
+
+func (err RelayDialError) Unwrap() error {
+	return err.Err
+}
+
+// RelayReadError is returned by ConnectRelay if reading from an established connection failed,
+// other than the relay closing the connection.
+type RelayReadError struct {
+	Err error
+}
+
+func (err RelayReadError) Error() string {
+	return fmt.Sprintf("failed to read from relay: %v", err.Err)
+}
+
+func (err RelayReadError) Unwrap() error {
+	return err.Err
+}
+
+// RelayWriteError is returned by ConnectRelay if writing a message to the relay failed.
+type RelayWriteError struct {
+	// Message describes what was being written, e.g. "register request".
+	Message string
+	Err     error
+}
+
+func (err RelayWriteError) Error() string {
+	return fmt.Sprintf("failed to write %s: %v", err.Message, err.Err)
+}
+
+func (err RelayWriteError) Unwrap() error {
+	return err.Err
+}
+
+// RelayProtocolError is returned by ConnectRelay if the relay sent something that doesn't follow the protocol.
+// This most likely means the relay isn't compatible with this version of the provider.
+type RelayProtocolError struct {
+	Message string
+}
+
+func (err RelayProtocolError) Error() string {
+	return fmt.Sprintf("relay protocol violation: %s", err.Message)
+}
+
+// RelayClosedError is returned by ConnectRelay if the relay closed the connection with a close frame.
+type RelayClosedError struct {
+	Status websocket.StatusCode
+	Reason string
+}
+
+func (err RelayClosedError) Error() string {
+	return fmt.Sprintf("relay closed the connection: %s (%s)", err.Status, err.Reason)
+}
+
+// newRelayReadError wraps an error from reading the relay connection,
+// returning a RelayClosedError if it was caused by a close frame.
+func newRelayReadError(err error) error {
+	var closeErr websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return RelayClosedError{Status: closeErr.Code, Reason: closeErr.Reason}
+	}
+	return RelayReadError{Err: err}
+}
+
+// shouldReconnect returns whether RunRelay should reconnect after ConnectRelay returned the given error.
+// Only rejected registrations won't be fixed by reconnecting. Everything else is retried, including protocol
+// violations, which may be caused by a relay that's misbehaving temporarily (e.g. during a deployment).
+func shouldReconnect(err error) bool {
+	var rejectedErr RegistrationRejectedError
+	return !errors.As(err, &rejectedErr)
+}
+
+// relayExitCode returns the exit code to use after RunRelay gave up with the given error.
+func relayExitCode(err error) int {
+	var rejectedErr RegistrationRejectedError
+	if errors.As(err, &rejectedErr) {
+		return exitCodeRegistrationRejected
+	}
+	return exitCodeFatal
+}
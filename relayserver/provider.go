@@ -0,0 +1,245 @@
+package relayserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+type WebsocketRequest[T any] struct {
+	Command string `json:"command"`
+	ReqID   int    `json:"id,omitempty"`
+	Data    T      `json:"data,omitempty"`
+}
+
+type RegisterBody struct {
+	Code     string          `json:"code,omitempty"`
+	Secret   string          `json:"secret,omitempty"`
+	Commit   string          `json:"commit,omitempty"`
+	Versions json.RawMessage `json:"versions,omitempty"`
+	Error    string          `json:"error,omitempty"`
+
+	ProtocolVersion int      `json:"protocol_version,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty"`
+}
+
+// ProtocolVersion is the newest relay protocol version supported by this server.
+// Providers that don't send a protocol version are assumed to use version 1,
+// which has a fixed set of capabilities.
+const ProtocolVersion = 2
+
+var (
+	// ServerCapabilities are advertised to providers in the register response.
+	ServerCapabilities = []string{"ping", "get-version-info", "get-validation-data", "subscribe-validation-data"}
+	legacyCapabilities = []string{"ping", "get-version-info", "get-validation-data"}
+)
+
+type ErrorResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+var ErrProviderDisconnected = errors.New("provider disconnected")
+var ErrUnsupportedCommand = errors.New("provider doesn't support command")
+
+// ProviderError is returned when the provider responds to a command with an error.
+type ProviderError struct {
+	Command string
+	Message string
+}
+
+func (err ProviderError) Error() string {
+	return fmt.Sprintf("provider returned error for %s: %s", err.Command, err.Message)
+}
+
+// provider is a single registered provider websocket connection.
+type provider struct {
+	code            string
+	commit          string
+	versions        json.RawMessage
+	protocolVersion int
+	capabilities    map[string]bool
+	conn            *websocket.Conn
+
+	reqID       int
+	waiters     map[int]chan json.RawMessage
+	waitersLock sync.Mutex
+	closed      chan struct{}
+
+	// latestData is the newest validation data pushed by the provider if subscribed.
+	latestData       json.RawMessage
+	latestValidUntil time.Time
+	latestLock       sync.RWMutex
+}
+
+type validationDataMeta struct {
+	ValidUntil time.Time `json:"valid_until"`
+}
+
+// storeData saves validation data pushed by the provider (or returned in a subscribe response).
+func (prov *provider) storeData(data json.RawMessage) {
+	var meta validationDataMeta
+	err := json.Unmarshal(data, &meta)
+	if err != nil || meta.ValidUntil.IsZero() {
+		slog.Warn("Provider pushed invalid validation data", "code", prov.code)
+		return
+	}
+	prov.latestLock.Lock()
+	defer prov.latestLock.Unlock()
+	if meta.ValidUntil.After(prov.latestValidUntil) {
+		prov.latestData = data
+		prov.latestValidUntil = meta.ValidUntil
+	}
+}
+
+// cachedData returns the latest pushed validation data if it's still valid for at least the given duration.
+func (prov *provider) cachedData(minValidity time.Duration) json.RawMessage {
+	prov.latestLock.RLock()
+	defer prov.latestLock.RUnlock()
+	if time.Now().Add(minValidity).After(prov.latestValidUntil) {
+		return nil
+	}
+	return prov.latestData
+}
+
+// subscribe asks the provider to push validation data before the previous data expires.
+func (prov *provider) subscribe(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	data, err := prov.Request(ctx, "subscribe-validation-data")
+	if err != nil {
+		slog.Warn("Failed to subscribe to validation data from provider", "code", prov.code, "error", err)
+		return
+	}
+	prov.storeData(data)
+}
+
+func newProvider(conn *websocket.Conn, code string, reg *RegisterBody) *provider {
+	protocolVersion := min(max(reg.ProtocolVersion, 1), ProtocolVersion)
+	providerCaps := reg.Capabilities
+	if reg.ProtocolVersion == 0 {
+		providerCaps = legacyCapabilities
+	}
+	capabilities := make(map[string]bool)
+	for _, capability := range providerCaps {
+		if slices.Contains(ServerCapabilities, capability) {
+			capabilities[capability] = true
+		}
+	}
+	return &provider{
+		code:            code,
+		commit:          reg.Commit,
+		versions:        reg.Versions,
+		protocolVersion: protocolVersion,
+		capabilities:    capabilities,
+		conn:            conn,
+		// Request ID 1 is used by the provider's register request
+		reqID:   1,
+		waiters: make(map[int]chan json.RawMessage),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Request sends a command to the provider and waits for the response data.
+func (prov *provider) Request(ctx context.Context, command string) (json.RawMessage, error) {
+	if !prov.capabilities[command] {
+		return nil, fmt.Errorf("%w %s", ErrUnsupportedCommand, command)
+	}
+	prov.waitersLock.Lock()
+	prov.reqID++
+	reqID := prov.reqID
+	waiter := make(chan json.RawMessage, 1)
+	prov.waiters[reqID] = waiter
+	prov.waitersLock.Unlock()
+	defer func() {
+		prov.waitersLock.Lock()
+		delete(prov.waiters, reqID)
+		prov.waitersLock.Unlock()
+	}()
+
+	err := wsjson.Write(ctx, prov.conn, &WebsocketRequest[any]{
+		Command: command,
+		ReqID:   reqID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send %s request: %w", command, err)
+	}
+	select {
+	case data := <-waiter:
+		var errResp ErrorResponse
+		if json.Unmarshal(data, &errResp) == nil && errResp.Error != "" {
+			return nil, ProviderError{Command: command, Message: errResp.Error}
+		}
+		return data, nil
+	case <-prov.closed:
+		return nil, ErrProviderDisconnected
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readLoop reads messages from the provider until the connection dies.
+func (prov *provider) readLoop(ctx context.Context) error {
+	defer close(prov.closed)
+	for {
+		var msg WebsocketRequest[json.RawMessage]
+		err := wsjson.Read(ctx, prov.conn, &msg)
+		if err != nil {
+			return err
+		}
+		switch msg.Command {
+		case "response":
+			prov.waitersLock.Lock()
+			waiter, ok := prov.waiters[msg.ReqID]
+			prov.waitersLock.Unlock()
+			if ok {
+				select {
+				case waiter <- msg.Data:
+				default:
+				}
+			} else {
+				slog.Warn("Provider sent response to unknown request", "code", prov.code, "req_id", msg.ReqID)
+			}
+		case "validation-data":
+			prov.storeData(msg.Data)
+		case "ping":
+			err = wsjson.Write(ctx, prov.conn, &WebsocketRequest[any]{
+				Command: "pong",
+				ReqID:   msg.ReqID,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to write pong: %w", err)
+			}
+		default:
+			slog.Warn("Provider sent unexpected command", "code", prov.code, "command", msg.Command, "req_id", msg.ReqID)
+		}
+	}
+}
+
+// pingLoop pings the provider periodically, which also makes it pre-generate validation data.
+func (prov *provider) pingLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			_, err := prov.Request(pingCtx, "ping")
+			cancel()
+			if err != nil {
+				slog.Warn("Failed to ping provider", "code", prov.code, "error", err)
+			}
+		case <-prov.closed:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
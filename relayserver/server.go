@@ -0,0 +1,194 @@
+// Package relayserver implements the server side of the registration relay protocol.
+//
+// Providers (mac-registration-provider in relay mode) connect to /api/v1/provider over a websocket
+// and register with a code and secret. Clients (i.e. bridges) can then fetch validation data from
+// the provider by sending the registration code as a bearer token to the /api/v1/bridge endpoints.
+package relayserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+type Config struct {
+	// StorePath is the file where registration codes and secrets are saved.
+	// If empty, registrations are only kept in memory, so providers get new codes after the server restarts.
+	StorePath string
+	// AdoptUnknownCodes makes the server accept registration codes it doesn't know with whatever secret
+	// the provider sends, e.g. to migrate providers from another relay server. Anyone who knows a code
+	// can then claim it, so it should only be enabled temporarily.
+	AdoptUnknownCodes bool
+	// RequestTimeout is the maximum time to wait for a provider to respond to a command.
+	RequestTimeout time.Duration
+	// PingInterval is the interval at which providers are pinged. Zero disables pinging.
+	PingInterval time.Duration
+}
+
+// minCachedValidity is how long data pushed by a subscribed provider must still be valid
+// for it to be returned to clients without asking the provider.
+const minCachedValidity = 1 * time.Minute
+
+type Server struct {
+	Config
+
+	store         *registrationStore
+	providers     map[string]*provider
+	providersLock sync.RWMutex
+}
+
+func New(cfg Config) (*Server, error) {
+	store, err := loadRegistrationStore(cfg.StorePath, cfg.AdoptUnknownCodes)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RequestTimeout == 0 {
+		cfg.RequestTimeout = 60 * time.Second
+	}
+	return &Server{
+		Config:    cfg,
+		store:     store,
+		providers: make(map[string]*provider),
+	}, nil
+}
+
+func (srv *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/provider", srv.handleProvider)
+	mux.HandleFunc("/api/v1/bridge/get-validation-data", srv.makeBridgeHandler("get-validation-data"))
+	mux.HandleFunc("/api/v1/bridge/get-version-info", srv.makeBridgeHandler("get-version-info"))
+	return mux
+}
+
+func (srv *Server) handleProvider(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	if err != nil {
+		slog.Warn("Failed to accept provider websocket", "remote_addr", r.RemoteAddr, "error", err)
+		return
+	}
+	defer conn.CloseNow()
+	ctx := r.Context()
+
+	var registerReq WebsocketRequest[*RegisterBody]
+	err = wsjson.Read(ctx, conn, &registerReq)
+	if err != nil {
+		slog.Warn("Failed to read register request", "remote_addr", r.RemoteAddr, "error", err)
+		return
+	} else if registerReq.Command != "register" || registerReq.Data == nil {
+		slog.Warn("Unexpected first command", "remote_addr", r.RemoteAddr, "command", registerReq.Command)
+		_ = conn.Close(websocket.StatusPolicyViolation, "expected register command")
+		return
+	}
+	code, secret, err := srv.store.register(registerReq.Data.Code, registerReq.Data.Secret)
+	if err != nil {
+		slog.Warn("Rejected registration", "remote_addr", r.RemoteAddr, "error", err)
+		_ = wsjson.Write(ctx, conn, &WebsocketRequest[*RegisterBody]{
+			Command: "response",
+			ReqID:   registerReq.ReqID,
+			Data:    &RegisterBody{Error: err.Error()},
+		})
+		_ = conn.Close(websocket.StatusPolicyViolation, "registration rejected")
+		return
+	}
+	prov := newProvider(conn, code, registerReq.Data)
+	err = wsjson.Write(ctx, conn, &WebsocketRequest[*RegisterBody]{
+		Command: "response",
+		ReqID:   registerReq.ReqID,
+		Data: &RegisterBody{
+			Code:            code,
+			Secret:          secret,
+			ProtocolVersion: prov.protocolVersion,
+			Capabilities:    ServerCapabilities,
+		},
+	})
+	if err != nil {
+		slog.Warn("Failed to write register response", "remote_addr", r.RemoteAddr, "error", err)
+		return
+	}
+
+	srv.providersLock.Lock()
+	oldProv, replaced := srv.providers[code]
+	srv.providers[code] = prov
+	srv.providersLock.Unlock()
+	if replaced {
+		_ = oldProv.conn.Close(websocket.StatusGoingAway, "replaced by new connection")
+	}
+	defer func() {
+		srv.providersLock.Lock()
+		if srv.providers[code] == prov {
+			delete(srv.providers, code)
+		}
+		srv.providersLock.Unlock()
+	}()
+	slog.Info("Provider registered", "code", code, "remote_addr", r.RemoteAddr, "commit", prov.commit, "protocol_version", prov.protocolVersion)
+
+	if srv.PingInterval > 0 && prov.capabilities["ping"] {
+		go prov.pingLoop(ctx, srv.PingInterval)
+	}
+	if prov.capabilities["subscribe-validation-data"] {
+		go prov.subscribe(ctx, srv.RequestTimeout)
+	}
+	err = prov.readLoop(ctx)
+	slog.Info("Provider disconnected", "code", code, "error", err)
+}
+
+func (srv *Server) getProvider(code string) *provider {
+	srv.providersLock.RLock()
+	defer srv.providersLock.RUnlock()
+	return srv.providers[code]
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func (srv *Server) makeBridgeHandler(command string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+			return
+		}
+		code, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || code == "" {
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "missing registration code"})
+			return
+		}
+		prov := srv.getProvider(code)
+		if prov == nil {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "no provider connected with that registration code"})
+			return
+		}
+		if command == "get-validation-data" {
+			if data := prov.cachedData(minCachedValidity); data != nil {
+				writeJSON(w, http.StatusOK, data)
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), srv.RequestTimeout)
+		defer cancel()
+		data, err := prov.Request(ctx, command)
+		var provErr ProviderError
+		if errors.Is(err, ErrUnsupportedCommand) {
+			writeJSON(w, http.StatusNotImplemented, ErrorResponse{Error: err.Error()})
+		} else if errors.As(err, &provErr) {
+			writeJSON(w, http.StatusBadGateway, ErrorResponse{Error: provErr.Message})
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			writeJSON(w, http.StatusGatewayTimeout, ErrorResponse{Error: "provider didn't respond in time"})
+		} else if err != nil {
+			slog.Error("Failed to send command to provider", "code", code, "command", command, "error", err)
+			writeJSON(w, http.StatusBadGateway, ErrorResponse{Error: err.Error()})
+		} else {
+			writeJSON(w, http.StatusOK, data)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package relayserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv, err := New(Config{RequestTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// connectTestProvider connects a provider with the given capabilities and returns its connection and code.
+func connectTestProvider(t *testing.T, ts *httptest.Server, capabilities []string) (*websocket.Conn, string) {
+	t.Helper()
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, ts.URL+"/api/v1/provider", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseNow() })
+	err = wsjson.Write(ctx, conn, &WebsocketRequest[*RegisterBody]{
+		Command: "register",
+		ReqID:   1,
+		Data:    &RegisterBody{ProtocolVersion: ProtocolVersion, Capabilities: capabilities},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp WebsocketRequest[*RegisterBody]
+	err = wsjson.Read(ctx, conn, &resp)
+	if err != nil {
+		t.Fatal(err)
+	} else if resp.Command != "response" || resp.ReqID != 1 || resp.Data == nil || resp.Data.Code == "" {
+		t.Fatalf("unexpected register response %+v", resp)
+	}
+	// The provider is only added to the server after the register response is written,
+	// but pings are answered once it has been added.
+	err = wsjson.Write(ctx, conn, &WebsocketRequest[any]{Command: "ping", ReqID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pong WebsocketRequest[json.RawMessage]
+	err = wsjson.Read(ctx, conn, &pong)
+	if err != nil {
+		t.Fatal(err)
+	} else if pong.Command != "pong" {
+		t.Fatalf("unexpected response to ping %+v", pong)
+	}
+	return conn, resp.Data.Code
+}
+
+func bridgeStatus(t *testing.T, ts *httptest.Server, command, authorization string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/bridge/"+command, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestBridgeAuth(t *testing.T) {
+	ts := newTestServer(t)
+	_, code := connectTestProvider(t, ts, []string{"get-version-info"})
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"missing header", "", http.StatusUnauthorized},
+		{"not bearer", "Basic " + code, http.StatusUnauthorized},
+		{"empty code", "Bearer ", http.StatusUnauthorized},
+		{"unknown code", "Bearer AAAA-BBBB-CCCC-DDDD", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status := bridgeStatus(t, ts, "get-version-info", test.authorization); status != test.want {
+				t.Errorf("got status %d, want %d", status, test.want)
+			}
+		})
+	}
+	resp, err := http.Get(ts.URL + "/api/v1/bridge/get-version-info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET without auth returned %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestBridgeUnsupportedCommand(t *testing.T) {
+	ts := newTestServer(t)
+	_, code := connectTestProvider(t, ts, []string{"get-version-info"})
+	if status := bridgeStatus(t, ts, "get-validation-data", "Bearer "+code); status != http.StatusNotImplemented {
+		t.Errorf("got status %d, want %d", status, http.StatusNotImplemented)
+	}
+}
+
+func TestRequestCorrelation(t *testing.T) {
+	ts := newTestServer(t)
+	conn, code := connectTestProvider(t, ts, []string{"get-version-info", "get-validation-data"})
+
+	const count = 3
+	results := make([]json.RawMessage, count)
+	statuses := make([]int, count)
+	var wg sync.WaitGroup
+	commands := []string{"get-version-info", "get-validation-data", "get-version-info"}
+	for i, command := range commands {
+		wg.Add(1)
+		go func(i int, command string) {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/bridge/"+command, nil)
+			req.Header.Set("Authorization", "Bearer "+code)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			statuses[i] = resp.StatusCode
+			_ = json.NewDecoder(resp.Body).Decode(&results[i])
+		}(i, command)
+	}
+
+	// Read all the requests before answering any, then answer them in reverse order.
+	// Each response contains the command and ID of the request it's for.
+	ctx := context.Background()
+	received := make([]WebsocketRequest[json.RawMessage], 0, count)
+	for len(received) < count {
+		var req WebsocketRequest[json.RawMessage]
+		if err := wsjson.Read(ctx, conn, &req); err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, req)
+	}
+	seenIDs := make(map[int]bool)
+	for i := len(received) - 1; i >= 0; i-- {
+		req := received[i]
+		if seenIDs[req.ReqID] || req.ReqID <= 1 {
+			t.Errorf("request ID %d is reused or reserved", req.ReqID)
+		}
+		seenIDs[req.ReqID] = true
+		err := wsjson.Write(ctx, conn, &WebsocketRequest[any]{
+			Command: "response",
+			ReqID:   req.ReqID,
+			Data:    map[string]any{"command": req.Command, "id": req.ReqID, "valid_until": time.Now().Add(time.Hour)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	for i, command := range commands {
+		if statuses[i] != http.StatusOK {
+			t.Errorf("request %d (%s) returned status %d", i, command, statuses[i])
+			continue
+		}
+		var resp struct {
+			Command string `json:"command"`
+			ID      int    `json:"id"`
+		}
+		if err := json.Unmarshal(results[i], &resp); err != nil {
+			t.Errorf("request %d (%s) returned invalid data: %v", i, command, err)
+		} else if resp.Command != command {
+			t.Errorf("request %d (%s) got the response to %s (id %d)", i, command, resp.Command, resp.ID)
+		}
+	}
+	// The two version info requests must have received the responses to different request IDs
+	var first, last struct {
+		ID int `json:"id"`
+	}
+	_ = json.Unmarshal(results[0], &first)
+	_ = json.Unmarshal(results[2], &last)
+	if first.ID == last.ID {
+		t.Errorf("both get-version-info requests got the response to request %d", first.ID)
+	}
+}
+
+func TestProviderErrorResponse(t *testing.T) {
+	ts := newTestServer(t)
+	conn, code := connectTestProvider(t, ts, []string{"get-version-info"})
+	go func() {
+		var req WebsocketRequest[json.RawMessage]
+		if err := wsjson.Read(context.Background(), conn, &req); err != nil {
+			return
+		}
+		_ = wsjson.Write(context.Background(), conn, &WebsocketRequest[any]{
+			Command: "response",
+			ReqID:   req.ReqID,
+			Data:    ErrorResponse{Error: "something broke"},
+		})
+	}()
+	if status := bridgeStatus(t, ts, "get-version-info", "Bearer "+code); status != http.StatusBadGateway {
+		t.Errorf("got status %d, want %d", status, http.StatusBadGateway)
+	}
+}
+
+func TestRegistrationStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store, err := loadRegistrationStore(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, secret, err := store.register("", "")
+	if err != nil {
+		t.Fatal(err)
+	} else if !isValidCode(code) || secret == "" {
+		t.Fatalf("generated invalid registration %q/%q", code, secret)
+	}
+
+	// Reload to make sure the registration was persisted
+	store, err = loadRegistrationStore(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotCode, gotSecret, err := store.register(code, secret); err != nil || gotCode != code || gotSecret != secret {
+		t.Errorf("re-registering returned %q/%q/%v", gotCode, gotSecret, err)
+	}
+	if _, _, err = store.register(code, "wrong"); !errors.Is(err, ErrInvalidSecret) {
+		t.Errorf("wrong secret returned %v, want %v", err, ErrInvalidSecret)
+	}
+	if _, _, err = store.register(code, ""); !errors.Is(err, ErrInvalidSecret) {
+		t.Errorf("empty secret returned %v, want %v", err, ErrInvalidSecret)
+	}
+	if _, _, err = store.register("not-a-code", "secret"); err == nil {
+		t.Error("malformed code was accepted")
+	}
+	// Unknown codes are rejected, so they can't be claimed by someone else after a restart
+	const unknown = "ABCD-EFGH-JKLM-NPQR"
+	if _, _, err = store.register(unknown, "secret"); !errors.Is(err, ErrUnknownCode) {
+		t.Errorf("unknown code returned %v, want %v", err, ErrUnknownCode)
+	}
+
+	// ...unless adopting them is explicitly enabled
+	adopting, err := loadRegistrationStore("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotCode, _, err := adopting.register(unknown, "secret"); err != nil || gotCode != unknown {
+		t.Errorf("adopting unknown code returned %q/%v", gotCode, err)
+	} else if _, _, err = adopting.register(unknown, "other"); !errors.Is(err, ErrInvalidSecret) {
+		t.Errorf("adopted code accepted a different secret: %v", err)
+	}
+}
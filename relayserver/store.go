@@ -0,0 +1,140 @@
+package relayserver
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+var (
+	ErrInvalidSecret = errors.New("invalid secret for registration code")
+	ErrUnknownCode   = errors.New("unknown registration code")
+)
+
+// registrationStore keeps track of which secret belongs to which registration code.
+// If path is set, the registrations are persisted there as JSON so that providers
+// can reconnect with their existing code after the server restarts.
+type registrationStore struct {
+	path string
+	// adoptUnknown makes register accept codes that aren't in the store, see Config.AdoptUnknownCodes.
+	adoptUnknown bool
+	lock         sync.Mutex
+	secrets      map[string]string
+}
+
+func loadRegistrationStore(path string, adoptUnknown bool) (*registrationStore, error) {
+	store := &registrationStore{path: path, adoptUnknown: adoptUnknown, secrets: make(map[string]string)}
+	if path == "" {
+		return store, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read registration store: %w", err)
+	}
+	err = json.Unmarshal(data, &store.secrets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse registration store: %w", err)
+	}
+	return store, nil
+}
+
+func (store *registrationStore) save() error {
+	if store.path == "" {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(store.path), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create registration store dir: %w", err)
+	}
+	data, err := json.Marshal(store.secrets)
+	if err != nil {
+		return fmt.Errorf("failed to encode registration store: %w", err)
+	}
+	err = os.WriteFile(store.path, data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write registration store: %w", err)
+	}
+	return nil
+}
+
+// register validates the code and secret sent by a provider. If the code is empty, a new code
+// and secret are generated. Codes that aren't known are rejected, unless adoptUnknown is set,
+// in which case they're adopted with the given secret.
+func (store *registrationStore) register(code, secret string) (string, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if code == "" {
+		for {
+			code = randomCode()
+			if _, exists := store.secrets[code]; !exists {
+				break
+			}
+		}
+		secret = randomSecret()
+	} else if !isValidCode(code) {
+		return "", "", fmt.Errorf("malformed registration code")
+	} else if secret == "" {
+		return "", "", ErrInvalidSecret
+	} else if existingSecret, exists := store.secrets[code]; exists {
+		if subtle.ConstantTimeCompare([]byte(existingSecret), []byte(secret)) != 1 {
+			return "", "", ErrInvalidSecret
+		}
+		return code, secret, nil
+	} else if !store.adoptUnknown {
+		return "", "", ErrUnknownCode
+	}
+	store.secrets[code] = secret
+	return code, secret, store.save()
+}
+
+func randomCode() string {
+	var buf [16]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		panic(err)
+	}
+	var out strings.Builder
+	for i, b := range buf {
+		if i > 0 && i%4 == 0 {
+			out.WriteByte('-')
+		}
+		out.WriteByte(codeAlphabet[int(b)%len(codeAlphabet)])
+	}
+	return out.String()
+}
+
+func isValidCode(code string) bool {
+	if len(code) != 19 {
+		return false
+	}
+	for i, chr := range code {
+		if i%5 == 4 {
+			if chr != '-' {
+				return false
+			}
+		} else if !strings.ContainsRune(codeAlphabet, chr) {
+			return false
+		}
+	}
+	return true
+}
+
+func randomSecret() string {
+	var buf [32]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf[:])
+}
@@ -6,7 +6,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 
 	"howett.net/plist"
@@ -92,9 +92,9 @@ func InitializeValidation(ctx context.Context, request []byte) (sessionInfo []by
 			var rawData map[string]any
 			_, plistErr := plist.Unmarshal(respData, &rawData)
 			if plistErr == nil {
-				log.Printf("Plist response data of errored request: %+v", rawData)
+				slog.Warn("Errored request response", "plist", fmt.Sprintf("%+v", rawData))
 			} else {
-				log.Printf("Raw response data of errored request: %s", base64.StdEncoding.EncodeToString(respData))
+				slog.Warn("Errored request response", "raw", base64.StdEncoding.EncodeToString(respData))
 			}
 		}
 	}()
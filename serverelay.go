@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/beeper/mac-registration-provider/relayserver"
+)
+
+func cmdServeRelay(args []string) {
+	flags := flag.NewFlagSet("serve-relay", flag.ExitOnError)
+	listen := flags.String("listen", ":8080", "Address to listen on")
+	storePath := flags.String("store", "", "File to save registration codes and secrets in (defaults to memory only)")
+	adoptUnknownCodes := flags.Bool("adopt-unknown-codes", false, "Accept registration codes that aren't in the store with any secret (unsafe, only for migrations)")
+	requestTimeout := flags.Duration("request-timeout", 60*time.Second, "Maximum time to wait for a provider to respond")
+	pingInterval := flags.Duration("ping-interval", 5*time.Minute, "Interval at which to ping providers (0 to disable)")
+	_ = flags.Parse(args)
+
+	srv, err := relayserver.New(relayserver.Config{
+		StorePath:         *storePath,
+		AdoptUnknownCodes: *adoptUnknownCodes,
+		RequestTimeout:    *requestTimeout,
+		PingInterval:      *pingInterval,
+	})
+	if err != nil {
+		fatal("Failed to create relay server", "error", err)
+	}
+	slog.Info("Relay server listening", "address", *listen)
+	err = http.ListenAndServe(*listen, srv.Handler())
+	if err != nil {
+		fatal("Failed to listen", "error", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// socketCapabilities are the capabilities available to unix socket clients, which don't negotiate anything.
+var socketCapabilities = NewCapabilitySet(providerCapabilities...)
+
+// runSocketServer serves the same commands as the relay connection over a unix socket, so that
+// clients on the same machine can fetch validation data without any network exposure.
+// Access is controlled by the permissions of the socket file.
+//
+// When ctx is canceled, the socket stops accepting connections and commands,
+// and runSocketServer returns after the commands being handled have been responded to.
+func runSocketServer(ctx context.Context, gen Generator, cfg SocketConfig) {
+	listener, err := listenUnixSocket(cfg)
+	if err != nil {
+		fatal("Failed to listen on unix socket", "error", err)
+	}
+	slog.Info("Socket mode: serving validation data", "path", cfg.Path)
+	stopClose := context.AfterFunc(ctx, func() {
+		_ = listener.Close()
+	})
+	defer stopClose()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			fatal("Failed to accept unix socket connection", "error", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handleSocketConn(ctx, gen, conn)
+		}()
+	}
+}
+
+// unixSocketListener removes the socket file when it's closed. net.UnixListener can't do that itself,
+// as the socket was created at a temporary path and then moved into place.
+type unixSocketListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (ul *unixSocketListener) Close() error {
+	err := ul.UnixListener.Close()
+	_ = os.Remove(ul.path)
+	return err
+}
+
+func listenUnixSocket(cfg SocketConfig) (net.Listener, error) {
+	mode, err := cfg.FileMode()
+	if err != nil {
+		return nil, err
+	}
+	var gid = -1
+	if cfg.Group != "" {
+		group, err := user.LookupGroup(cfg.Group)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up group: %w", err)
+		}
+		gid, err = strconv.Atoi(group.Gid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse group ID: %w", err)
+		}
+	}
+	if stat, err := os.Lstat(cfg.Path); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		// Remove stale socket from a previous run
+		_ = os.Remove(cfg.Path)
+	}
+	// Create the socket in a private directory and only move it into place after the chmod below,
+	// so it's never accessible with the default permissions. Changing the umask instead would also
+	// affect the permissions of files that other goroutines create in the meantime.
+	tmpDir, err := os.MkdirTemp(filepath.Dir(cfg.Path), ".socket-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary socket directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpPath := filepath.Join(tmpDir, "s")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	if gid != -1 {
+		err = os.Chown(tmpPath, -1, gid)
+		if err != nil {
+			_ = listener.Close()
+			return nil, fmt.Errorf("failed to change socket group: %w", err)
+		}
+	}
+	err = os.Chmod(tmpPath, mode)
+	if err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to change socket permissions: %w", err)
+	}
+	err = os.Rename(tmpPath, cfg.Path)
+	if err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to move socket into place: %w", err)
+	}
+	return &unixSocketListener{UnixListener: listener, path: cfg.Path}, nil
+}
+
+// handleSocketConn reads newline-delimited JSON commands from the connection and writes the responses,
+// using the same message format as the relay websocket.
+func handleSocketConn(shutdownCtx context.Context, gen Generator, conn net.Conn) {
+	defer conn.Close()
+	// Stop reading new commands on shutdown, but let the current one finish
+	stopCloseRead := context.AfterFunc(shutdownCtx, func() {
+		_ = conn.(*net.UnixConn).CloseRead()
+	})
+	defer stopCloseRead()
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+	var writeLock sync.Mutex
+	write := func(msg WebsocketRequest[any]) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		return encoder.Encode(msg)
+	}
+	ctx, cancel := context.WithCancel(withMetricsMode(context.WithoutCancel(shutdownCtx), ModeSocket))
+	defer cancel()
+	handler := &commandHandler{
+		gen:  gen,
+		caps: socketCapabilities,
+		push: func(ctx context.Context, command string, data any) error {
+			return write(WebsocketRequest[any]{Command: command, Data: data})
+		},
+	}
+	for {
+		var req WebsocketRequest[json.RawMessage]
+		err := decoder.Decode(&req)
+		if errors.Is(err, io.EOF) || shutdownCtx.Err() != nil {
+			return
+		} else if err != nil {
+			slog.Warn("Failed to read command from unix socket", "error", err)
+			return
+		}
+		start := time.Now()
+		resp, err := handler.handleCommand(ctx, req)
+		if err != nil {
+			slog.Error("Command from unix socket failed", "command", req.Command, "req_id", req.ReqID, "duration", time.Since(start), "error", err)
+			resp = ErrorResponse{Error: err.Error()}
+		} else if resp == nil {
+			continue
+		} else {
+			slog.Info("Command from unix socket succeeded", "command", req.Command, "req_id", req.ReqID, "duration", time.Since(start))
+		}
+		emitEvent(EventCommand, CommandEvent{
+			ResultEvent: resultEvent(err),
+			Source:      ModeSocket,
+			Command:     req.Command,
+			ReqID:       req.ReqID,
+			Duration:    time.Since(start).Seconds(),
+		})
+		err = write(WebsocketRequest[any]{
+			Command: "response",
+			ReqID:   req.ReqID,
+			Data:    resp,
+		})
+		if err != nil {
+			slog.Warn("Failed to write response to unix socket", "error", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+		want os.FileMode
+	}{
+		{"default", "", 0600},
+		{"group", "660", 0660},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "provider.sock")
+			// A socket left behind by a previous run is replaced
+			stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stale.SetUnlinkOnClose(false)
+			_ = stale.Close()
+
+			listener, err := listenUnixSocket(SocketConfig{Path: path, Mode: test.mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stat, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			} else if stat.Mode()&os.ModeSocket == 0 {
+				t.Errorf("%s isn't a socket: %s", path, stat.Mode())
+			} else if stat.Mode().Perm() != test.want {
+				t.Errorf("got mode %o, want %o", stat.Mode().Perm(), test.want)
+			}
+			if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+				t.Errorf("temporary socket directory left behind: %v %v", entries, err)
+			}
+			if err = listener.Close(); err != nil {
+				t.Fatal(err)
+			} else if _, err = os.Lstat(path); !os.IsNotExist(err) {
+				t.Errorf("socket not removed after close: %v", err)
+			}
+		})
+	}
+}
+
+func TestSocketServer(t *testing.T) {
+	resetCache(t)
+	path := filepath.Join(t.TempDir(), "provider.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runSocketServer(ctx, &FakeGenerator{}, SocketConfig{Path: path})
+	}()
+	defer func() {
+		cancel()
+		<-done
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("socket not removed after shutdown: %v", err)
+		}
+	}()
+
+	var conn net.Conn
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	send := func(command string, reqID int) {
+		t.Helper()
+		if _, err := conn.Write([]byte(`{"command": "` + command + `", "id": ` + strconv.Itoa(reqID) + "}\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func(reqID int, data any) {
+		t.Helper()
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp WebsocketRequest[json.RawMessage]
+		if err = json.Unmarshal(line, &resp); err != nil {
+			t.Fatal(err)
+		} else if resp.Command != "response" || resp.ReqID != reqID {
+			t.Fatalf("got %s for request %d, want response for request %d", resp.Command, resp.ReqID, reqID)
+		} else if err = json.Unmarshal(resp.Data, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send("get-version-info", 1)
+	var versionsResp VersionsResponse
+	receive(1, &versionsResp)
+	if versionsResp.Versions != currentVersionsResponse().Versions {
+		t.Errorf("got versions %+v", versionsResp.Versions)
+	}
+
+	send("get-validation-data", 2)
+	var dataResp ValidationDataResponse
+	receive(2, &dataResp)
+	if len(dataResp.Data) == 0 || time.Until(dataResp.ValidUntil) <= 0 {
+		t.Errorf("invalid validation data response %+v", dataResp)
+	}
+
+	// Pongs aren't answered, so the next response is for the unknown command
+	send("pong", 3)
+	send("nonexistent", 4)
+	var errResp ErrorResponse
+	receive(4, &errResp)
+	if !strings.Contains(errResp.Error, `unknown command "nonexistent"`) {
+		t.Errorf("got error %q for unknown command", errResp.Error)
+	}
+}
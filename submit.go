@@ -3,87 +3,233 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"runtime/debug"
+	"net/url"
 	"sync"
 	"time"
 
 	"github.com/beeper/mac-registration-provider/versions"
 )
 
-var panicCounter = 0
+const (
+	submitAttemptTimeout  = 30 * time.Second
+	submitInitialBackoff  = 2 * time.Second
+	submitMaxBackoff      = 1 * time.Minute
+	submitRetryMinimumTTL = 10 * time.Second
+	// submitValidityMargin is how much longer than the submit interval submitted data must be valid for,
+	// so that receivers have valid data until the next submission arrives.
+	submitValidityMargin = 2 * time.Minute
+)
+
+// runSubmitLoops groups the targets by interval and runs a submit loop for each group.
+// Payloads left in the outbox by a previous run are redelivered first.
+// It returns after ctx is canceled and the submits in progress have finished.
+func runSubmitLoops(ctx context.Context, gen Generator, targets []SubmitTarget, outbox *submitOutbox) {
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		if payload := outbox.Get(target.URL); payload != nil {
+			slog.Info("Redelivering validation data from outbox", "target", target.URL, "valid_until", payload.ValidUntil)
+			wg.Add(1)
+			go func(target SubmitTarget) {
+				defer wg.Done()
+				submitWithRetries(ctx, target, payload, outbox)
+			}(target)
+		}
+	}
+	groups := make(map[time.Duration][]SubmitTarget)
+	for _, target := range targets {
+		groups[target.Interval] = append(groups[target.Interval], target)
+	}
+	wg.Add(len(groups))
+	for interval, group := range groups {
+		loop := &submitLoop{gen: gen, targets: group, interval: interval, outbox: outbox}
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				loop.generateAndSubmit(ctx)
+			}
+		}()
+	}
+	wg.Wait()
+}
 
-func generateAndSubmit(urls []string) {
-	defer func() {
-		err := recover()
-		if err != nil {
-			panicCounter++
-			log.Printf("Panic while generating validation data: %v\n%s", err, debug.Stack())
-			sleepDuration := time.Duration(panicCounter) * 5 * time.Minute
-			log.Println("Sleeping for", sleepDuration)
-			time.Sleep(sleepDuration)
+type submitLoop struct {
+	gen      Generator
+	targets  []SubmitTarget
+	interval time.Duration
+	outbox   *submitOutbox
+	// lastValidUntil is the expiry of the last submitted data, used to avoid submitting the same data twice.
+	lastValidUntil time.Time
+}
+
+func (sl *submitLoop) generateAndSubmit(ctx context.Context) {
+	slog.Debug("Generating validation data")
+	data, err := cachedGenerateDataFor(withMetricsMode(ctx, "submit"), sl.gen, sl.interval+submitValidityMargin, sl.lastValidUntil)
+	if err != nil {
+		// Waiting for generation is canceled on shutdown, which isn't worth an error
+		if ctx.Err() == nil {
+			slog.Error("Failed to generate validation data", "error", err)
 		}
-	}()
-	log.Println("Generating validation data...")
-	if validationData, validUntil, err := GenerateValidationData(context.Background()); err != nil {
-		log.Printf("Failed to generate validation data: %v", err)
 	} else {
-		submitValidationDataToURLs(context.Background(), urls, validationData, validUntil)
+		sl.lastValidUntil = data.ValidUntil
+		submitValidationDataToTargets(ctx, sl.targets, &ReqSubmitValidationData{
+			ValidationData: data.Data,
+			ValidUntil:     data.ValidUntil,
+			NacservCommit:  Commit,
+			DeviceInfo:     versions.Current,
+		}, sl.outbox)
 	}
-	panicCounter = 0
-	time.Sleep(*submitInterval)
+	sleepContext(ctx, sl.interval)
 }
 
-func submitValidationDataToURLs(ctx context.Context, urls []string, data []byte, validUntil time.Time) {
-	var cancel context.CancelFunc
-	ctx, cancel = context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
+// sleepContext sleeps for the given duration or until ctx is canceled.
+func sleepContext(ctx context.Context, duration time.Duration) {
+	select {
+	case <-time.After(duration):
+	case <-ctx.Done():
+	}
+}
+
+func submitValidationDataToTargets(ctx context.Context, targets []SubmitTarget, payload *ReqSubmitValidationData, outbox *submitOutbox) {
 	var wg sync.WaitGroup
-	wg.Add(len(urls))
-	for _, u := range urls {
-		go func(addr string) {
+	wg.Add(len(targets))
+	for _, t := range targets {
+		go func(target SubmitTarget) {
 			defer wg.Done()
-			err := submitValidationData(ctx, addr, data, validUntil)
-			if err != nil {
-				log.Printf("Failed to submit validation data to %s: %v", addr, err)
-			} else {
-				log.Println("Submitted validation data to", addr)
-			}
-		}(u)
+			submitWithRetries(ctx, target, payload, outbox)
+		}(t)
 	}
 	wg.Wait()
 }
 
-func submitValidationData(ctx context.Context, url string, data []byte, validUntil time.Time) error {
-	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(&ReqSubmitValidationData{
-		ValidationData: data,
-		ValidUntil:     validUntil,
-		NacservCommit:  Commit,
-		DeviceInfo:     versions.Current,
+// submitWithRetries submits the payload to the target, retrying with exponential backoff
+// until it succeeds, fails permanently, or the payload is about to expire.
+//
+// Canceling ctx doesn't abort the attempt in progress, but no more retries are made after it,
+// and the payload is left in the outbox so that it's redelivered after a restart.
+func submitWithRetries(shutdownCtx context.Context, target SubmitTarget, payload *ReqSubmitValidationData, outbox *submitOutbox) {
+	start := time.Now()
+	outbox.Put(target.URL, payload)
+	ctx, cancel := context.WithDeadline(context.WithoutCancel(shutdownCtx), payload.ValidUntil)
+	defer cancel()
+	backoff := submitInitialBackoff
+	var err error
+	attempts := 1
+	for ; ; attempts++ {
+		attemptCtx, cancelAttempt := context.WithTimeout(ctx, submitAttemptTimeout)
+		err = submitValidationData(attemptCtx, target, payload)
+		cancelAttempt()
+		metricSubmitAttempts.WithLabelValues(target.metricsLabel(), resultLabel(err)).Inc()
+		if err == nil || !isRetryableSubmitError(err) {
+			break
+		} else if time.Until(payload.ValidUntil) < backoff+submitRetryMinimumTTL {
+			err = fmt.Errorf("%w (giving up as data expires soon)", err)
+			break
+		}
+		slog.Warn("Failed to submit validation data, retrying", "target", target.URL, "attempt", attempts, "error", err, "retry_in", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		case <-shutdownCtx.Done():
+		}
+		if shutdownCtx.Err() != nil {
+			err = fmt.Errorf("%w (giving up due to shutdown)", err)
+			break
+		}
+		backoff = min(backoff*2, submitMaxBackoff)
+	}
+	if err != nil {
+		slog.Error("Failed to submit validation data", "target", target.URL, "attempts", attempts, "duration", time.Since(start), "error", err)
+	} else {
+		slog.Info("Submitted validation data", "target", target.URL, "attempts", attempts, "duration", time.Since(start))
+	}
+	metricSubmissions.WithLabelValues(target.metricsLabel(), resultLabel(err)).Inc()
+	// Permanently failed or expired payloads won't be retried on restart either
+	if err == nil || shutdownCtx.Err() == nil {
+		outbox.Remove(target.URL, payload)
+	}
+	emitEvent(EventSubmit, SubmitEvent{
+		ResultEvent: resultEvent(err),
+		Target:      target.URL,
+		Attempts:    attempts,
+		Duration:    time.Since(start).Seconds(),
 	})
+}
+
+type SubmitStatusError struct {
+	StatusCode int
+}
+
+func (err SubmitStatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", err.StatusCode)
+}
+
+// isRetryableSubmitError returns false for client errors that won't be fixed by retrying, like bad auth.
+func isRetryableSubmitError(err error) bool {
+	var statusErr SubmitStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusRequestTimeout || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+func submitValidationData(ctx context.Context, target SubmitTarget, payload *ReqSubmitValidationData) error {
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(payload)
 	if err != nil {
 		return fmt.Errorf("failed to encode request payload: %w", err)
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.URL, bytes.NewReader(buf.Bytes()))
 	if err != nil {
 		return fmt.Errorf("failed to prepare request: %w", err)
 	}
-	req.Header.Set("User-Agent", submitUserAgent)
-	req.Header.Set("Content-Type", "application/json")
-	if len(*submitToken) > 0 {
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", *submitToken))
-	}
+	target.addHeaders(req, buf.Bytes())
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %w", err)
 	}
 	_ = resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		return SubmitStatusError{StatusCode: resp.StatusCode}
 	}
 	return nil
 }
+
+// metricsLabel returns the name of the target for metric labels. Unless the target has an explicit name,
+// only the host and path of the URL are used, so that credentials in the URL don't end up in metrics.
+func (target *SubmitTarget) metricsLabel() string {
+	if target.Name != "" {
+		return target.Name
+	}
+	parsedURL, err := url.Parse(target.URL)
+	if err != nil {
+		return "invalid"
+	}
+	return parsedURL.Host + parsedURL.Path
+}
+
+// addHeaders adds the standard headers and the target-specific authentication headers to a request.
+func (target *SubmitTarget) addHeaders(req *http.Request, body []byte) {
+	for name, value := range target.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("User-Agent", submitUserAgent)
+	req.Header.Set("Content-Type", "application/json")
+	if len(target.Token) > 0 {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", target.Token))
+	} else if target.BasicAuth != nil {
+		req.SetBasicAuth(target.BasicAuth.Username, target.BasicAuth.Password)
+	}
+	if target.HMAC != nil {
+		mac := hmac.New(sha256.New, []byte(target.HMAC.Secret))
+		mac.Write(body)
+		req.Header.Set(target.HMAC.Header, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const (
+	// subscriptionRefreshLead is how long before expiry pushed data is replaced.
+	// It matches the threshold at which cachedGenerateData regenerates data.
+	subscriptionRefreshLead = 5 * time.Minute
+	subscriptionRetryDelay  = 30 * time.Second
+)
+
+// subscribe starts pushing fresh validation data to the client before the previous data expires.
+// The current data is returned as the response to the subscribe command.
+func (ch *commandHandler) subscribe(ctx context.Context) (ValidationDataResponse, error) {
+	data, err := cachedGenerateData(ctx, ch.gen)
+	if err != nil {
+		return data, err
+	}
+	if ch.subscribed.CompareAndSwap(false, true) {
+		go ch.pushLoop(ctx, data.ValidUntil)
+	}
+	return data, nil
+}
+
+func (ch *commandHandler) pushLoop(ctx context.Context, lastValidUntil time.Time) {
+	defer ch.subscribed.Store(false)
+	// Wake up slightly after the refresh threshold, so the pushed data is no longer served from the cache
+	nextRefresh := lastValidUntil.Add(-subscriptionRefreshLead + time.Second)
+	for {
+		select {
+		case <-time.After(time.Until(nextRefresh)):
+		case <-ctx.Done():
+			return
+		}
+		data, err := cachedGenerateDataFor(ctx, ch.gen, minServeValidity, lastValidUntil)
+		if err != nil {
+			slog.Warn("Failed to generate validation data for subscription", "error", err, "retry_in", subscriptionRetryDelay)
+			nextRefresh = time.Now().Add(subscriptionRetryDelay)
+			continue
+		}
+		err = ch.push(ctx, "validation-data", data)
+		if err != nil {
+			slog.Warn("Failed to push validation data to subscriber", "error", err)
+			return
+		}
+		slog.Info("Pushed validation data to subscriber", "valid_until", data.ValidUntil)
+		lastValidUntil = data.ValidUntil
+		nextRefresh = lastValidUntil.Add(-subscriptionRefreshLead + time.Second)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !darwin
+
+package versions
+
+import (
+	"os"
+	"runtime"
+	"strings"
+)
+
+func getMachineID() string {
+	machineID, _ := os.ReadFile("/etc/machine-id")
+	return strings.TrimSpace(string(machineID))
+}
+
+// Get returns placeholder versions on non-macOS platforms, where there's no real NAC
+// and validation data can only come from a fake generator.
+func Get() Versions {
+	return Versions{
+		HardwareVersion: runtime.GOARCH,
+		SoftwareName:    runtime.GOOS,
+		SoftwareVersion: "0.0.0",
+		SoftwareBuildID: "unknown",
+
+		UniqueDeviceID: getMachineID(),
+		Hostname:       getHostname(),
+	}
+}